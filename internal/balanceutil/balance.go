@@ -4,13 +4,22 @@ import (
 	"balansir/internal/cacheutil"
 	"balansir/internal/configutil"
 	"balansir/internal/dispatchutil"
+	"balansir/internal/forwardutil"
 	"balansir/internal/helpers"
 	"balansir/internal/limitutil"
 	"balansir/internal/logutil"
 	"balansir/internal/metricsutil"
 	"balansir/internal/poolutil"
+	"balansir/internal/routeutil"
+	"balansir/internal/serverutil"
 	"balansir/internal/staticutil"
+	"balansir/internal/tunnelutil"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 const (
@@ -22,46 +31,289 @@ const (
 	LeastConnectionsType = "least-connections"
 	//WeightedLeastConnectionsType ...
 	WeightedLeastConnectionsType = "weighted-least-connections"
+	//ConsistentHashType ...
+	ConsistentHashType = "consistent-hash"
+	//P2CEWMAType ...
+	P2CEWMAType = "p2c-ewma"
 )
 
-//RoundRobin ...
-func RoundRobin(w http.ResponseWriter, r *http.Request) {
-	pool := poolutil.GetPool()
-	index := pool.NextPool()
-	endpoint := pool.ServerList[index]
+const (
+	hashKeyIP     = "ip"
+	hashKeyHeader = "header"
+	hashKeyCookie = "cookie"
+	hashKeyQuery  = "query"
+	hashKeyPath   = "path"
+)
 
-	dispatchutil.Dispatch(endpoint, w, r)
+const (
+	defaultRetryBodySize       = 64 * 1024
+	defaultRetryBudgetPercent  = 20
+	defaultMinRetriesPerSecond = 3
+)
+
+//RoundRobin ...
+func RoundRobin(pool *poolutil.ServerPool, servers []*serverutil.Server) *serverutil.Server {
+	return pool.GetNextServer(servers)
 }
 
 //WeightedRoundRobin ...
-func WeightedRoundRobin(w http.ResponseWriter, r *http.Request) {
-	pool := poolutil.GetPool()
-	poolChoice := pool.GetPoolChoice()
-	endpoint, err := poolutil.WeightedChoice(poolChoice)
+func WeightedRoundRobin(pool *poolutil.ServerPool, servers []*serverutil.Server) *serverutil.Server {
+	return pool.GetSmoothWeightedServer(servers)
+}
 
-	if err != nil {
-		logutil.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+//LeastConnections ...
+func LeastConnections(pool *poolutil.ServerPool, servers []*serverutil.Server) *serverutil.Server {
+	return pool.GetLeastConnectedServer(servers)
+}
+
+//WeightedLeastConnections ...
+func WeightedLeastConnections(pool *poolutil.ServerPool, servers []*serverutil.Server) *serverutil.Server {
+	return pool.GetWeightedLeastConnectedServer(servers)
+}
+
+//P2CEWMA ...
+func P2CEWMA(pool *poolutil.ServerPool, servers []*serverutil.Server) *serverutil.Server {
+	return pool.GetP2CServer(servers)
+}
+
+//ConsistentHash ...
+func ConsistentHash(pool *poolutil.ServerPool, servers []*serverutil.Server, r *http.Request, excluded []*serverutil.Server) *serverutil.Server {
+	key := getHashKey(pool, r)
+	endpoint := pool.Maglev.Get(servers, key)
+
+	//Look further for the retried requests, keeping the table intact
+	for i := 1; i <= len(servers) && included(excluded, endpoint); i++ {
+		endpoint = pool.Maglev.Get(servers, fmt.Sprintf("%s#%v", key, i))
+	}
+	if included(excluded, endpoint) {
+		return nil
 	}
 
-	dispatchutil.Dispatch(endpoint, w, r)
+	//Warming up server hands a part of its keys over to the next servers
+	if endpoint != nil && !pool.SlowStartKeeps(endpoint, key) {
+		skipped := append(append([]*serverutil.Server{}, excluded...), endpoint)
+		for i := 1; i <= len(servers); i++ {
+			if next := pool.Maglev.Get(servers, fmt.Sprintf("%s#%v", key, i)); !included(skipped, next) {
+				return next
+			}
+		}
+	}
+
+	return endpoint
 }
 
-//LeastConnections ...
-func LeastConnections(w http.ResponseWriter, r *http.Request) {
-	pool := poolutil.GetPool()
-	endpoint := pool.GetLeastConnectedServer()
+func getHashKey(pool *poolutil.ServerPool, r *http.Request) string {
+	consistentHash := pool.GetUpstream().ConsistentHash
 
-	dispatchutil.Dispatch(endpoint, w, r)
+	switch consistentHash.Key {
+	case hashKeyHeader:
+		if val := r.Header.Get(consistentHash.Name); val != "" {
+			return val
+		}
+	case hashKeyCookie:
+		if cookie, err := r.Cookie(consistentHash.Name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	case hashKeyQuery:
+		if val := r.URL.Query().Get(consistentHash.Name); val != "" {
+			return val
+		}
+	case hashKeyPath:
+		if r.URL.Path != "" {
+			return r.URL.Path
+		}
+	}
+
+	//Client IP is used by default and when the configured attribute is missing in the request
+	return forwardutil.ClientIP(r)
 }
 
-//WeightedLeastConnections ...
-func WeightedLeastConnections(w http.ResponseWriter, r *http.Request) {
-	pool := poolutil.GetPool()
-	endpoint := pool.GetWeightedLeastConnectedServer()
+func included(servers []*serverutil.Server, server *serverutil.Server) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+//SelectServer chooses a server with the configured algorithm, skipping unavailable and excluded ones
+func SelectServer(pool *poolutil.ServerPool, r *http.Request, excluded []*serverutil.Server) *serverutil.Server {
+	available := pool.AvailableServers()
+	//Servers at their max requests limit are skipped the same way as the excluded ones
+	excluded = append(append([]*serverutil.Server{}, excluded...), poolutil.GetBusyServers(available)...)
+	servers := poolutil.ExcludeServers(available, excluded)
+	if len(servers) == 0 {
+		return nil
+	}
+
+	switch pool.GetUpstream().Algorithm {
+	case RoundRobinType:
+		return RoundRobin(pool, servers)
+
+	case WeightedRoundRobinType:
+		return WeightedRoundRobin(pool, servers)
+
+	case LeastConnectionsType:
+		return LeastConnections(pool, servers)
+
+	case WeightedLeastConnectionsType:
+		return WeightedLeastConnections(pool, servers)
+
+	case ConsistentHashType:
+		return ConsistentHash(pool, available, r, excluded)
+
+	case P2CEWMAType:
+		return P2CEWMA(pool, servers)
+	}
+
+	return nil
+}
+
+//acquireServer selects a server and takes its request slot. While all the servers
+//are at their limits, the request waits in the pool queue.
+func acquireServer(pool *poolutil.ServerPool, r *http.Request, excluded []*serverutil.Server) (*serverutil.Server, error) {
+	deadline := time.Now().Add(pool.QueueTimeout())
+	requeued := false
+	for {
+		//Newcomers line up behind the queued requests
+		if requeued || !pool.Queue.Queued() {
+			endpoint := SelectServer(pool, r, excluded)
+			if endpoint == nil && len(poolutil.ExcludeServers(pool.AvailableServers(), excluded)) == 0 {
+				return nil, nil
+			}
+			if endpoint != nil && endpoint.TryAcquire() {
+				return endpoint, nil
+			}
+		}
+
+		if err := pool.Queue.Wait(r.Context(), pool.GetUpstream().Queue.Size, deadline, requeued); err != nil {
+			return nil, err
+		}
+		requeued = true
+	}
+}
 
-	dispatchutil.Dispatch(endpoint, w, r)
+func serviceUnavailable(pool *poolutil.ServerPool, w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(pool.RetryAfter()))
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+//forward dispatches the request to the acquired endpoint, retrying on the other ones if allowed
+func forward(pool *poolutil.ServerPool, endpoint *serverutil.Server, w http.ResponseWriter, r *http.Request) {
+	retry := getRetrySettings(pool)
+	pool.RetryBudget.HitRequest()
+
+	var body []byte
+	replayable := false
+	if retry.Enabled && retry.MaxRetries > 0 {
+		var err error
+		body, replayable, err = helpers.BufferRequestBody(r, retry.MaxBodySize)
+		if err != nil {
+			logutil.Warning(fmt.Sprintf("Error reading request body: %v", err))
+			pool.Release(endpoint)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := dispatchutil.Dispatch(pool, endpoint, w, r)
+	pool.Release(endpoint)
+	retryFailed(pool, retry, w, r, []*serverutil.Server{endpoint}, err, body, replayable)
+}
+
+//retryFailed dispatches the failed request to the servers that haven't been tried yet,
+//as long as it's allowed to. Client gets 502 if none of them succeeds.
+func retryFailed(pool *poolutil.ServerPool, retry configutil.Retry, w http.ResponseWriter, r *http.Request, tried []*serverutil.Server, err error, body []byte, replayable bool) {
+	for attempt := 0; ; attempt++ {
+		if err == nil || errors.Is(err, context.Canceled) {
+			return
+		}
+
+		if !replayable || attempt >= retry.MaxRetries || !retryable(r, err) {
+			break
+		}
+		if !pool.RetryBudget.Withdraw(retry.BudgetPercent, retry.MinRetriesPerSecond) {
+			logutil.Warning("Retry budget exhausted")
+			break
+		}
+
+		endpoint, acquireErr := acquireServer(pool, r, tried)
+		if endpoint == nil || acquireErr != nil {
+			break
+		}
+		tried = append(tried, endpoint)
+
+		//Drop session cookie set for the failed server
+		w.Header().Del("Set-Cookie")
+		helpers.ResetRequestBody(r, body)
+
+		err = dispatchutil.Dispatch(pool, endpoint, w, r)
+		pool.Release(endpoint)
+	}
+
+	http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+}
+
+func getRetrySettings(pool *poolutil.ServerPool) configutil.Retry {
+	retry := pool.GetUpstream().Retry
+	if retry.MaxBodySize <= 0 {
+		retry.MaxBodySize = defaultRetryBodySize
+	}
+	if retry.BudgetPercent <= 0 {
+		retry.BudgetPercent = defaultRetryBudgetPercent
+	}
+	if retry.MinRetriesPerSecond <= 0 {
+		retry.MinRetriesPerSecond = defaultMinRetriesPerSecond
+	}
+	return retry
+}
+
+//Requests that never reached the server can be safely retried with any method
+func retryable(r *http.Request, err error) bool {
+	var upstreamErr *dispatchutil.UpstreamError
+	if errors.As(err, &upstreamErr) && !upstreamErr.Connected {
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+//mirror sends a copy of the request to the shadow pool in background.
+//Requests with bodies bigger than the limit aren't mirrored, neither are the ones
+//over the limit of concurrent shadow requests.
+func mirror(m *routeutil.Mirror, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	shadowPool := poolutil.GetPoolByName(m.Upstream)
+	if shadowPool == nil || !m.Shadow.TryStart(m.MaxConcurrent) {
+		return w, nil
+	}
+
+	body, replayable, err := helpers.BufferRequestBody(r, m.MaxBodySize)
+	if err != nil || !replayable {
+		m.Shadow.Done()
+		return w, nil
+	}
+
+	timeout := time.Duration(shadowPool.GetUpstream().WriteTimeout) * time.Second
+	shadowRequest, cancel := dispatchutil.NewMirrorRequest(r, body, timeout)
+
+	go func() {
+		defer m.Shadow.Done()
+		defer cancel()
+		start := time.Now()
+		status := http.StatusServiceUnavailable
+		if endpoint := SelectServer(shadowPool, shadowRequest, nil); endpoint != nil && endpoint.TryAcquire() {
+			status = dispatchutil.Mirror(shadowPool, endpoint, shadowRequest)
+			shadowPool.Release(endpoint)
+		}
+		m.Shadow.Record(status, time.Since(start))
+	}()
+
+	return routeutil.Track(w, m.Primary, nil)
 }
 
 //NewServeMux ...
@@ -74,6 +326,7 @@ func NewServeMux() *http.ServeMux {
 	sm.HandleFunc("/balansir/logs/collected_logs", metricsutil.CollectedLogs)
 	sm.HandleFunc("/balansir/metrics/stats", metricsutil.MetrictStats)
 	sm.HandleFunc("/balansir/metrics/collected_stats", metricsutil.CollectedStats)
+	sm.HandleFunc("/balansir/cache/purge", cacheutil.PurgeHandler)
 	sm.Handle("/content/", http.StripPrefix("/content/", http.FileServer(http.Dir("content"))))
 	return sm
 }
@@ -94,14 +347,15 @@ func LoadBalance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	cache := cacheutil.GetCluster()
-	if configuration.Cache.Enabled && cache != nil {
+	if configuration.Cache.Enabled && cache != nil && !tunnelutil.IsUpgrade(r) {
 		if err := cacheutil.TryServeFromCache(w, r); err == nil {
 			return
 		}
+		w = cacheutil.StaleIfError(w, r)
 	}
 
 	if configuration.RateLimit {
-		ip := helpers.ReturnIPFromHost(r.RemoteAddr)
+		ip := forwardutil.ClientIP(r)
 		visitors := limitutil.GetLimiter()
 		limiter := visitors.GetVisitor(ip, configuration)
 		if !limiter.Allow() {
@@ -110,15 +364,39 @@ func LoadBalance(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	//Shadow requests are copied with the forwarding headers already in place
+	forwardutil.SetHeaders(r, configuration.TransparentProxy)
+
 	pool := poolutil.GetPool()
-	availableServers := poolutil.ExcludeUnavailableServers(pool.ServerList)
+	route := routeutil.GetTable().Match(r)
+	if route != nil {
+		upstream := route.Upstream
+		if route.Split != nil {
+			variant, assigned := route.Split.Choose(r)
+			var done func()
+			w, done = route.Split.Track(w, variant, assigned)
+			defer done()
+			upstream = variant.Upstream
+		}
+		if routed := poolutil.GetPoolByName(upstream); routed != nil {
+			pool = routed
+		}
+	}
+
+	availableServers := pool.AvailableServers()
 	if len(availableServers) == 0 {
-		w.WriteHeader(http.StatusInternalServerError)
+		serviceUnavailable(pool, w)
 		return
 	}
 
-	if configuration.TransparentProxy {
-		r = helpers.AddRemoteAddrToRequest(r)
+	//Excess of requests is shed as soon as the pool's latency starts to grow.
+	//Tunnels are left out, their lifetime tells nothing about the backend's latency.
+	if adaptive := limitutil.GetAdaptiveSettings(&pool.GetUpstream().AdaptiveConcurrency); adaptive.Enabled && !tunnelutil.IsUpgrade(r) {
+		if !pool.Limiter.Acquire(adaptive) {
+			serviceUnavailable(pool, w)
+			return
+		}
+		defer pool.Limiter.Release()
 	}
 
 	if configuration.SessionPersistence {
@@ -130,24 +408,43 @@ func LoadBalance(w http.ResponseWriter, r *http.Request) {
 				// continue to algorithm switching to choose a new server.
 				// Also, consider disabling this behavior with configuration.
 				logutil.Warning(err)
-			} else {
-				dispatchutil.Dispatch(endpoint, w, r)
+			} else if included(availableServers, endpoint) && endpoint.TryAcquire() {
+				serve(pool, endpoint, route, w, r)
 				return
 			}
 		}
 	}
 
-	switch configuration.Algorithm {
-	case RoundRobinType:
-		RoundRobin(w, r)
+	endpoint, err := acquireServer(pool, r, nil)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if endpoint == nil {
+		serviceUnavailable(pool, w)
+		return
+	}
 
-	case WeightedRoundRobinType:
-		WeightedRoundRobin(w, r)
+	serve(pool, endpoint, route, w, r)
+}
 
-	case LeastConnectionsType:
-		LeastConnections(w, r)
+func serve(pool *poolutil.ServerPool, endpoint *serverutil.Server, route *routeutil.Route, w http.ResponseWriter, r *http.Request) {
+	if route == nil {
+		forward(pool, endpoint, w, r)
+		return
+	}
 
-	case WeightedLeastConnectionsType:
-		WeightedLeastConnections(w, r)
+	//Request is shadowed only once it's got a server, so the shadow pool doesn't see the requests
+	//turned away by the primary one. Shadow pool can't take over the client's connection.
+	if route.Mirror != nil && !tunnelutil.IsUpgrade(r) && route.Mirror.Sample() {
+		var done func()
+		if w, done = mirror(route.Mirror, w, r); done != nil {
+			defer done()
+		}
+	}
+
+	if route.Hedge != nil && hedgeable(r) {
+		hedge(pool, endpoint, route.Hedge, w, r)
+		return
 	}
+	forward(pool, endpoint, w, r)
 }
@@ -0,0 +1,220 @@
+package balanceutil
+
+import (
+	"balansir/internal/dispatchutil"
+	"balansir/internal/poolutil"
+	"balansir/internal/routeutil"
+	"balansir/internal/serverutil"
+	"balansir/internal/tunnelutil"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Percentile of the pool's response time used when hedge delay isn't configured
+const hedgePercentile = 95
+
+//hedgeable requests are the ones safe to send twice
+func hedgeable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || tunnelutil.IsUpgrade(r) {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody
+}
+
+//hedge dispatches the request to the acquired endpoint and, if no response comes within
+//the delay, sends a copy of it to another server. The first response wins, the other
+//request is cancelled. If both attempts fail, the request is retried as a regular one.
+func hedge(pool *poolutil.ServerPool, endpoint *serverutil.Server, h *routeutil.Hedge, w http.ResponseWriter, r *http.Request) {
+	delay := h.Delay
+	if delay <= 0 {
+		delay = pool.Latencies.Percentile(hedgePercentile)
+	}
+	//Nothing to compare with yet
+	if delay <= 0 {
+		forward(pool, endpoint, w, r)
+		return
+	}
+
+	pool.HedgeBudget.HitRequest()
+	pool.RetryBudget.HitRequest()
+	race := &hedgeRace{w: w, done: make(chan struct{})}
+	results := make(chan error, 2)
+	tried := []*serverutil.Server{endpoint}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	race.add(cancel)
+	go func() {
+		results <- race.dispatch(pool, endpoint, 0, r.WithContext(ctx))
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var err error
+	attempts := 1
+	select {
+	case err = <-results:
+		attempts--
+		if err == nil || race.claimed() {
+			race.cancelAll()
+			return
+		}
+	case <-race.done:
+	case <-timer.C:
+		//Response might've come at the same time the timer fired, the hedge is of no use then
+		select {
+		case <-race.done:
+		default:
+			if hedged := hedgeEndpoint(pool, endpoint, h, r); hedged != nil {
+				ctx, cancel := context.WithCancel(r.Context())
+				race.add(cancel)
+				tried = append(tried, hedged)
+				attempts++
+				go func() {
+					results <- race.dispatch(pool, hedged, 1, r.Clone(ctx))
+				}()
+			}
+		}
+	}
+
+	for ; attempts > 0; attempts-- {
+		if attemptErr := <-results; attemptErr != nil {
+			err = attemptErr
+		}
+	}
+	race.cancelAll()
+
+	//Hedgeable requests have no body, so they can always be replayed
+	if !race.claimed() {
+		retry := getRetrySettings(pool)
+		retryFailed(pool, retry, w, r, tried, err, nil, retry.Enabled && retry.MaxRetries > 0)
+	}
+}
+
+func hedgeEndpoint(pool *poolutil.ServerPool, endpoint *serverutil.Server, h *routeutil.Hedge, r *http.Request) *serverutil.Server {
+	if !pool.HedgeBudget.Withdraw(h.BudgetPercent, h.MinPerSecond) {
+		return nil
+	}
+
+	hedged := SelectServer(pool, r, []*serverutil.Server{endpoint})
+	if hedged == nil || !hedged.TryAcquire() {
+		return nil
+	}
+	pool.HitHedge()
+	return hedged
+}
+
+//hedgeRace hands the client's response writer to the first attempt that gets a response
+type hedgeRace struct {
+	mux     sync.Mutex
+	w       http.ResponseWriter
+	winner  int
+	won     bool
+	cancels []context.CancelFunc
+	done    chan struct{}
+}
+
+func (hr *hedgeRace) add(cancel context.CancelFunc) {
+	hr.mux.Lock()
+	defer hr.mux.Unlock()
+	hr.cancels = append(hr.cancels, cancel)
+}
+
+func (hr *hedgeRace) dispatch(pool *poolutil.ServerPool, endpoint *serverutil.Server, attempt int, r *http.Request) error {
+	defer pool.Release(endpoint)
+	return dispatchutil.Dispatch(pool, endpoint, &hedgeWriter{race: hr, attempt: attempt, header: http.Header{}}, r)
+}
+
+//claim makes the attempt the winner, unless there is one already. The other attempts are cancelled.
+func (hr *hedgeRace) claim(attempt int) bool {
+	hr.mux.Lock()
+	defer hr.mux.Unlock()
+
+	if hr.won {
+		return hr.winner == attempt
+	}
+	hr.won = true
+	hr.winner = attempt
+	for i, cancel := range hr.cancels {
+		if i != attempt {
+			cancel()
+		}
+	}
+	close(hr.done)
+	return true
+}
+
+func (hr *hedgeRace) claimed() bool {
+	hr.mux.Lock()
+	defer hr.mux.Unlock()
+	return hr.won
+}
+
+func (hr *hedgeRace) cancelAll() {
+	hr.mux.Lock()
+	defer hr.mux.Unlock()
+	for _, cancel := range hr.cancels {
+		cancel()
+	}
+}
+
+//hedgeWriter keeps the attempt's headers aside until the attempt wins the race,
+//the loser's response is discarded
+type hedgeWriter struct {
+	race    *hedgeRace
+	attempt int
+	header  http.Header
+	status  int
+	winner  bool
+}
+
+func (hw *hedgeWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *hedgeWriter) WriteHeader(status int) {
+	if hw.status != 0 {
+		return
+	}
+	hw.status = status
+
+	if !hw.race.claim(hw.attempt) {
+		return
+	}
+	hw.winner = true
+	header := hw.race.w.Header()
+	for key, val := range hw.header {
+		header[key] = val
+	}
+	hw.race.w.WriteHeader(status)
+}
+
+func (hw *hedgeWriter) Write(b []byte) (int, error) {
+	if hw.status == 0 {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.winner {
+		return len(b), nil
+	}
+	return hw.race.w.Write(b)
+}
+
+func (hw *hedgeWriter) Flush() {
+	if !hw.winner {
+		return
+	}
+	w := hw.race.w
+	for {
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+			return
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		w = unwrapper.Unwrap()
+	}
+}
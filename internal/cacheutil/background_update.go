@@ -1,23 +1,42 @@
 package cacheutil
 
 import (
+	"balansir/internal/configutil"
+	"balansir/internal/logutil"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 )
 
-//Updater ...
+const (
+	revalidationWorkers   = 16
+	revalidationQueueSize = 1024
+)
+
+//Updater refreshes the expired responses with a fixed number of workers,
+//so a lot of entries expiring at once don't flood the origin
 type Updater struct {
-	client     *http.Client
-	keyStorage *KeyStorage
-	port       int
+	client        *http.Client
+	keyStorage    *KeyStorage
+	port          int
+	inFlight      map[string]bool
+	mux           sync.Mutex
+	revalidations chan *revalidation
+}
+
+type revalidation struct {
+	key    string
+	value  []byte
+	header http.Header
+	tags   []string
 }
 
 //NewUpdater ...
 func NewUpdater(port int, transportTimeout int, dialerTimeout int) *Updater {
-	return &Updater{
+	updater := &Updater{
 		client: &http.Client{
 			Timeout: time.Duration(transportTimeout) * time.Second,
 			Transport: &http.Transport{
@@ -26,23 +45,129 @@ func NewUpdater(port int, transportTimeout int, dialerTimeout int) *Updater {
 				}).Dial,
 			},
 		},
-		keyStorage: NewKeyStorage(),
-		port:       port,
+		keyStorage:    NewKeyStorage(),
+		port:          port,
+		inFlight:      make(map[string]bool),
+		revalidations: make(chan *revalidation, revalidationQueueSize),
+	}
+	for i := 0; i < revalidationWorkers; i++ {
+		go updater.work()
+	}
+	return updater
+}
+
+//Revalidate queues the background refresh of the response. There is a single refresh
+//of the key at a time. Header carries the values the response varies on, tags are
+//set again on the unchanged response if it's been deleted on expiration.
+//It returns false if the queue is full, the refresh is left for the next attempt then.
+func (u *Updater) Revalidate(key string, value []byte, header http.Header, tags []string) bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.inFlight[key] {
+		return true
+	}
+
+	select {
+	case u.revalidations <- &revalidation{key: key, value: value, header: header, tags: tags}:
+		u.inFlight[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *Updater) work() {
+	for r := range u.revalidations {
+		if err := u.InvalidateCachedResponse(r.key, r.value, r.header, r.tags); err != nil {
+			logutil.Error(err)
+		}
+
+		u.mux.Lock()
+		delete(u.inFlight, r.key)
+		u.mux.Unlock()
 	}
 }
 
-//InvalidateCachedResponse ...
-func (u *Updater) InvalidateCachedResponse(url string, mux *sync.RWMutex) error {
-	mux.Unlock()
-	defer mux.Lock()
+//Headers of the 304 response that update the revalidated entry, validators are updated apart from them
+var revalidatedHeaders = []string{"Cache-Control", "Expires", "Date"}
 
-	req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%v%v", u.port, url), nil)
+//InvalidateCachedResponse refetches the expired response. It's revalidated with a conditional
+//request first, so the origin doesn't need to send the body again if it hasn't changed.
+func (u *Updater) InvalidateCachedResponse(key string, value []byte, header http.Header, tags []string) error {
+	host, requestURI := splitKey(key)
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%v%v", u.port, requestURI), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	for name, values := range header {
+		req.Header[name] = values
+	}
 	req.Header.Set("X-Balansir-Background-Update", "true")
+
+	entry, err := DecodeEntry(value)
+	if err == nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != 0 {
+			req.Header.Set("If-Modified-Since", entry.LastModifiedTime().Format(http.TimeFormat))
+		}
+	}
+
 	res, err := u.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusNotModified || entry == nil {
+		return nil
+	}
+	return refresh(key, entry, res, tags)
+}
+
+//refresh stores the unchanged entry again, with the freshness of the 304 response
+func refresh(key string, entry *Entry, res *http.Response, tags []string) error {
+	for _, name := range revalidatedHeaders {
+		if val := res.Header.Values(name); len(val) > 0 {
+			entry.Header[name] = val
+		}
+	}
+	entry.UpdateValidators(res.Header)
+
+	_, requestURI := splitKey(key)
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return err
+	}
+	configuration := configutil.GetConfig()
+	rule := GetRule(u.Path, configuration.Cache.Rules)
+	if rule == nil {
+		return nil
+	}
+
+	TTL := rule.TTL
+	var age time.Duration
+	rfc := configuration.Cache.Mode == RFCMode
+	revalidated := &http.Response{StatusCode: entry.Status, Header: entry.Header, Request: res.Request}
+	if rfc {
+		var ok bool
+		TTL, age, ok = Storable(revalidated, rule)
+		if !ok {
+			return nil
+		}
+	}
+	entry.StoredAt = time.Now().Add(-age).Unix()
+	entry.TTL = TTL
+	entry.StaleWhileRevalidate, entry.StaleIfError = StaleWindows(revalidated, rule, rfc)
+
+	cache := GetCluster()
+	if err := cache.Set(key, entry.Encode(), TTL, entry.Grace()); err != nil {
+		return err
+	}
+	if tags != nil {
+		cache.SetTags(key, tags)
+	}
 	return nil
 }
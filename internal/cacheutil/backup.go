@@ -28,6 +28,7 @@ type Snapshot struct {
 	Misses      int64
 	Shards      []*Shard
 	KsHashMap   map[uint64]string
+	TagsHashMap map[uint64][]string
 }
 
 //Hit ...
@@ -97,8 +98,9 @@ func (bm *BackupManager) takeCacheSnapshot() {
 	}
 
 	snapshot := &Snapshot{
-		Shards:    cluster.shards,
-		KsHashMap: cluster.updater.keyStorage.hashmap,
+		Shards:      cluster.shards,
+		KsHashMap:   cluster.updater.keyStorage.hashmap,
+		TagsHashMap: cluster.tags.snapshot(),
 	}
 
 	bm.Reset()
@@ -149,6 +151,30 @@ func RestoreCache() {
 
 	cluster.shards = snapshot.Shards
 	cluster.updater.keyStorage.hashmap = snapshot.KsHashMap
+	cluster.tags.restore(snapshot.TagsHashMap)
+
+	if dropped := cluster.dropIncompatible(); dropped > 0 {
+		logutil.Notice(fmt.Sprintf("%v cache entries of an older format dropped from the snapshot", dropped))
+	}
 
 	logutil.Notice("Cache loaded from disk")
 }
+
+//dropIncompatible removes the restored entries that aren't of the current version
+func (cluster *CacheCluster) dropIncompatible() int {
+	var hashedKeys []uint64
+	for _, shard := range cluster.shards {
+		shard.mux.RLock()
+		for hashedKey, item := range shard.Hashmap {
+			if checkEntry(shard.Items[item.Index]) != nil {
+				hashedKeys = append(hashedKeys, hashedKey)
+			}
+		}
+		shard.mux.RUnlock()
+	}
+
+	for _, hashedKey := range hashedKeys {
+		cluster.delete(hashedKey)
+	}
+	return len(hashedKeys)
+}
@@ -12,7 +12,6 @@ import (
 	"net/http"
 	"runtime/debug"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,15 +25,6 @@ const (
 	pow2 = float64(int64(1) << 31)
 )
 
-var (
-	//KeyValueDelimeter ...
-	KeyValueDelimeter = []byte(";balansir-key-value-delimeter;")
-	//PairDelimeter ...
-	PairDelimeter = []byte(";balansir-pair-delimeter;")
-	//HeadersDelimeter ...
-	HeadersDelimeter = []byte(";balansir-headers-delimeter;")
-)
-
 type fnv64a struct{}
 
 func (f fnv64a) Sum(key string) uint64 {
@@ -57,8 +47,11 @@ type CacheCluster struct {
 	Queue            *Queue
 	Hits             int64
 	Misses           int64
+	Purges           int64
 	backgroundUpdate bool
 	updater          *Updater
+	vary             *VaryStorage
+	tags             *TagStorage
 	cacheRules       []*configutil.Rule
 	Mux              sync.RWMutex
 }
@@ -88,6 +81,8 @@ func New(args CacheClusterArgs) *CacheCluster {
 		cacheRules:       args.CacheRules,
 		backgroundUpdate: args.BackgroundUpdate,
 		updater:          NewUpdater(args.Port, args.TransportTimeout, args.DialerTimeout),
+		vary:             NewVaryStorage(),
+		tags:             NewTagStorage(),
 	}
 
 	for i := 0; i < args.ShardsAmount; i++ {
@@ -127,7 +122,7 @@ func (cluster *CacheCluster) getShard(hashedKey uint64) *Shard {
 }
 
 //Set ...
-func (cluster *CacheCluster) Set(key string, value []byte, TTL string) (err error) {
+func (cluster *CacheCluster) Set(key string, value []byte, TTL string, grace int64) (err error) {
 	hashedKey := cluster.Hash.Sum(key)
 	shard := cluster.getShard(hashedKey)
 	shard.mux.Lock()
@@ -143,7 +138,7 @@ func (cluster *CacheCluster) Set(key string, value []byte, TTL string) (err erro
 		}
 	}
 
-	shard.set(hashedKey, value, TTL)
+	shard.set(hashedKey, value, TTL, grace)
 	cluster.updater.keyStorage.SetHashedKey(key, hashedKey)
 
 	cluster.backupManager.Hit()
@@ -156,6 +151,12 @@ func (cluster *CacheCluster) Get(key string, trackMisses bool) ([]byte, error) {
 	hashedKey := cluster.Hash.Sum(key)
 	shard := cluster.getShard(hashedKey)
 	value, err := shard.get(hashedKey)
+	//Entry that can't be decoded is never served, so it's dropped to be stored again
+	if err == nil {
+		if err = checkEntry(value); err != nil {
+			cluster.delete(hashedKey)
+		}
+	}
 
 	if err == nil {
 		cluster.hit()
@@ -169,6 +170,45 @@ func (cluster *CacheCluster) Get(key string, trackMisses bool) ([]byte, error) {
 	return value, err
 }
 
+//delete removes the entry from its shard and forgets its key and tags.
+//It returns false if there is no entry for the key.
+func (cluster *CacheCluster) delete(hashedKey uint64) bool {
+	shard := cluster.getShard(hashedKey)
+	shard.mux.Lock()
+	item, ok := shard.Hashmap[hashedKey]
+	if ok {
+		shard.delete(hashedKey, item.Index, item.Length)
+	}
+	shard.mux.Unlock()
+
+	//Key and tags restored from the snapshot may outlive the entry
+	if !ok {
+		cluster.forget(hashedKey)
+	}
+	return ok
+}
+
+//forget removes the key and tags of the deleted entry
+func (cluster *CacheCluster) forget(hashedKey uint64) {
+	cluster.updater.keyStorage.DeleteHashedKey(hashedKey)
+	cluster.tags.DeleteHashedKey(hashedKey)
+}
+
+//SetVary remembers the headers the responses for the key vary on
+func (cluster *CacheCluster) SetVary(key string, names []string) {
+	cluster.vary.SetHeaders(cluster.Hash.Sum(key), names)
+}
+
+//VariantKey returns the key of the request's variant of the cached response
+func (cluster *CacheCluster) VariantKey(key string, r *http.Request) string {
+	return VariantKey(key, cluster.vary.GetHeaders(cluster.Hash.Sum(key)), r)
+}
+
+//SetTags replaces the surrogate keys of the cached response
+func (cluster *CacheCluster) SetTags(key string, tags []string) {
+	cluster.tags.SetTags(cluster.Hash.Sum(key), tags)
+}
+
 func (cluster *CacheCluster) invalidate(timestamp int64) {
 	for _, shard := range cluster.shards {
 		shard.update(timestamp, cluster.updater)
@@ -183,31 +223,42 @@ func (cluster *CacheCluster) runInvalidation() {
 	}
 }
 
-//ServeFromCache ...
-func ServeFromCache(w http.ResponseWriter, r *http.Request, value []byte) {
-	slicedValue := bytes.Split(value, HeadersDelimeter)
-	headers := slicedValue[0]
-	body := slicedValue[1]
-
-	headersPairs := bytes.Split(headers, PairDelimeter)
-	for _, pair := range headersPairs {
-		slicedPair := bytes.Split(pair, KeyValueDelimeter)
-		for i := range slicedPair {
-			//Prevent writing last pair value as a separate key
-			if i+1 <= len(slicedPair)-1 {
-				w.Header().Set(string(slicedPair[i]), string(slicedPair[i+1]))
-			}
-		}
+//ServeFromCache answers the request with the cached response. Conditional and range requests
+//are answered from the cache as well.
+func ServeFromCache(w http.ResponseWriter, r *http.Request, value []byte) error {
+	entry, err := DecodeEntry(value)
+	if err != nil {
+		return err
 	}
 
-	bodyBuf := bytes.NewBuffer([]byte{})
-	bodyBuf.Write(body)
+	serveEntry(w, r, entry, "HIT")
+	return nil
+}
 
-	_, err := w.Write(bodyBuf.Bytes())
+func serveEntry(w http.ResponseWriter, r *http.Request, entry *Entry, cacheStatus string) {
+	for key, val := range entry.Header {
+		w.Header()[key] = val
+	}
+	entry.WriteValidators(w.Header())
+	//Prevent content type sniffing if the origin sent none
+	if _, ok := entry.Header["Content-Type"]; !ok {
+		w.Header()["Content-Type"] = nil
+	}
+	if entry.StoredAt > 0 {
+		w.Header().Set("Age", strconv.FormatInt(entry.Age(), 10))
+	}
+	w.Header().Set("X-Cache", cacheStatus)
 
-	if err != nil {
-		logutil.Error(err)
+	//Conditional and range requests make sense for complete responses only
+	if entry.Status != http.StatusOK {
+		w.WriteHeader(entry.Status)
+		if _, err := w.Write(entry.Body); err != nil {
+			logutil.Error(err)
+		}
+		return
 	}
+
+	http.ServeContent(w, r, "", entry.LastModifiedTime(), bytes.NewReader(entry.Body))
 }
 
 //GetHitRatio ...
@@ -247,6 +298,7 @@ func RedefineCache(args *CacheClusterArgs) error {
 		backupManager:    cluster.backupManager,
 		Hits:             cluster.Hits,
 		Misses:           cluster.Misses,
+		Purges:           cluster.Purges,
 		ShardsAmount:     cluster.ShardsAmount,
 		ShardSize:        args.ShardSize,
 		shards:           cluster.shards,
@@ -254,6 +306,8 @@ func RedefineCache(args *CacheClusterArgs) error {
 		backgroundUpdate: args.BackgroundUpdate,
 		cacheRules:       args.CacheRules,
 		updater:          cluster.updater,
+		vary:             cluster.vary,
+		tags:             cluster.tags,
 	}
 
 	if cluster.ShardsAmount != args.ShardsAmount {
@@ -280,20 +334,34 @@ func CacheEquals(cacheHash *string, incomingArgs *CacheClusterArgs) bool {
 //TryServeFromCache ...
 func TryServeFromCache(w http.ResponseWriter, r *http.Request) error {
 	configuration := configutil.GetConfig()
-	mustBeCached, _ := ContainsRule(r.URL.String(), configuration.Cache.Rules)
+	mustBeCached, _ := ContainsRule(r.URL.Path, configuration.Cache.Rules)
 
 	if !mustBeCached {
 		return fmt.Errorf("%s shouldn't be cached", r.URL.Path)
 	}
 
+	if configuration.Cache.Mode == RFCMode && !Lookupable(r) {
+		return fmt.Errorf("%s %s can't be served from cache", r.Method, r.URL.Path)
+	}
+
 	cache := GetCluster()
-	response, err := cache.Get(r.URL.String(), false)
+	key := Key(r)
+	variantKey := cache.VariantKey(key, r)
+	response, err := cache.Get(variantKey, false)
 	if err == nil {
-		ServeFromCache(w, r, response)
+		if err = ServeFromCache(w, r, response); err == nil {
+			return nil
+		}
+		logutil.Error(err)
+	}
+
+	//Background update must reach the origin
+	if r.Header.Get("X-Balansir-Background-Update") == "" && cache.serveStale(w, r, key, variantKey) {
 		return nil
 	}
+	w.Header().Set("X-Cache", "MISS")
 
-	hashedKey := cache.Hash.Sum(r.URL.String())
+	hashedKey := cache.Hash.Sum(key)
 	transaction := cache.Queue.Get(hashedKey)
 	//If there is no queue for a given key – create queue and set release on timeout.
 	//Timeout should prevent situation when release won't be triggered in modifyResponse
@@ -309,13 +377,14 @@ func TryServeFromCache(w http.ResponseWriter, r *http.Request) error {
 		}()
 	} else {
 		//If there is a queue for a given key – wait for it to be released and get the response
-		//from the cache. Optimistically we don't need to check the returned error in this case,
-		//because the only error is a "key not found" yet we immediatelly grab the value after
-		//cache set.
+		//from the cache. The response may be missing if it wasn't stored, e.g. it's uncacheable
+		//or it's another variant, then the request goes to the origin.
 		transaction.Wait()
-		response, _ := cache.Get(r.URL.String(), false)
-		ServeFromCache(w, r, response)
-		return nil
+		response, err := cache.Get(cache.VariantKey(key, r), false)
+		if err != nil {
+			return err
+		}
+		return ServeFromCache(w, r, response)
 	}
 
 	return err
@@ -323,10 +392,8 @@ func TryServeFromCache(w http.ResponseWriter, r *http.Request) error {
 
 //ContainsRule ...
 func ContainsRule(path string, prefixes []*configutil.Rule) (ok bool, ttl string) {
-	for _, rule := range prefixes {
-		if strings.HasPrefix(path, rule.Path) {
-			return true, rule.TTL
-		}
+	if rule := GetRule(path, prefixes); rule != nil {
+		return true, rule.TTL
 	}
 	return false, ""
 }
@@ -0,0 +1,293 @@
+package cacheutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+//Entry layout, all integers are big endian:
+//
+//	magic        4 bytes "BLSR"
+//	version      uint8
+//	status       uint16
+//	stored at    int64, unix seconds
+//	ttl          uint16 length + bytes
+//	etag         uint16 length + bytes
+//	last mod     int64, unix seconds, 0 if unknown
+//	swr          int64, stale-while-revalidate window in seconds
+//	sie          int64, stale-if-error window in seconds
+//	headers      uint32 count, each one is
+//	               name   uint16 length + bytes
+//	               values uint32 count, each one is uint32 length + bytes
+//	body         uint32 length + bytes
+const (
+	entryVersion = 2
+	entryMagic   = "BLSR"
+)
+
+//Entry is a cached response. Validators are kept apart from the rest of the headers.
+//Stale windows are the seconds after the expiration the entry may still be served in.
+type Entry struct {
+	Status               int
+	Header               http.Header
+	Body                 []byte
+	StoredAt             int64
+	TTL                  string
+	ETag                 string
+	LastModified         int64
+	StaleWhileRevalidate int64
+	StaleIfError         int64
+}
+
+//ErrMalformedEntry ...
+var ErrMalformedEntry = errors.New("malformed cache entry")
+
+//NewEntry ...
+func NewEntry(status int, header http.Header, body []byte, storedAt int64, TTL string) *Entry {
+	entry := &Entry{
+		Status:   status,
+		Header:   header.Clone(),
+		Body:     body,
+		StoredAt: storedAt,
+		TTL:      TTL,
+	}
+	entry.UpdateValidators(header)
+	return entry
+}
+
+//UpdateValidators takes the validators from the headers, if there are any
+func (e *Entry) UpdateValidators(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" {
+		e.ETag = etag
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		e.LastModified = lastModified.Unix()
+	}
+	e.Header.Del("ETag")
+	e.Header.Del("Last-Modified")
+}
+
+//WriteValidators ...
+func (e *Entry) WriteValidators(header http.Header) {
+	if e.ETag != "" {
+		header.Set("ETag", e.ETag)
+	}
+	if e.LastModified != 0 {
+		header.Set("Last-Modified", e.LastModifiedTime().Format(http.TimeFormat))
+	}
+}
+
+//LastModifiedTime ...
+func (e *Entry) LastModifiedTime() time.Time {
+	if e.LastModified == 0 {
+		return time.Time{}
+	}
+	return time.Unix(e.LastModified, 0).UTC()
+}
+
+//Encode ...
+func (e *Entry) Encode() []byte {
+	size := len(entryMagic) + 1 + 2 + 8 + 2 + len(e.TTL) + 2 + len(e.ETag) + 8 + 8 + 8 + 4 + 4 + len(e.Body)
+	for name, values := range e.Header {
+		size += 2 + len(name) + 4
+		for _, val := range values {
+			size += 4 + len(val)
+		}
+	}
+
+	b := make([]byte, 0, size)
+	b = append(b, entryMagic...)
+	b = append(b, entryVersion)
+	b = appendUint16(b, uint16(e.Status))
+	b = appendUint64(b, uint64(e.StoredAt))
+	b = appendString16(b, e.TTL)
+	b = appendString16(b, e.ETag)
+	b = appendUint64(b, uint64(e.LastModified))
+	b = appendUint64(b, uint64(e.StaleWhileRevalidate))
+	b = appendUint64(b, uint64(e.StaleIfError))
+
+	b = appendUint32(b, uint32(len(e.Header)))
+	for name, values := range e.Header {
+		b = appendString16(b, name)
+		b = appendUint32(b, uint32(len(values)))
+		for _, val := range values {
+			b = appendUint32(b, uint32(len(val)))
+			b = append(b, val...)
+		}
+	}
+
+	b = appendUint32(b, uint32(len(e.Body)))
+	b = append(b, e.Body...)
+
+	return b
+}
+
+//DecodeEntry ...
+func DecodeEntry(value []byte) (*Entry, error) {
+	if err := checkEntry(value); err != nil {
+		return nil, err
+	}
+
+	r := &entryReader{b: value, off: len(entryMagic) + 1}
+
+	entry := &Entry{
+		Status:   int(r.uint16()),
+		StoredAt: int64(r.uint64()),
+		TTL:      r.string16(),
+		ETag:     r.string16(),
+	}
+	entry.LastModified = int64(r.uint64())
+	entry.StaleWhileRevalidate = int64(r.uint64())
+	entry.StaleIfError = int64(r.uint64())
+
+	count := r.uint32()
+	//Every header takes 6 bytes at least, so the count can't make us allocate more than the entry holds
+	if r.err == nil && uint64(count)*6 > uint64(r.remaining()) {
+		return nil, ErrMalformedEntry
+	}
+	entry.Header = make(http.Header, count)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		name := r.string16()
+		valuesCount := r.uint32()
+		if r.err == nil && uint64(valuesCount)*4 > uint64(r.remaining()) {
+			return nil, ErrMalformedEntry
+		}
+		values := make([]string, 0, valuesCount)
+		for j := uint32(0); j < valuesCount && r.err == nil; j++ {
+			values = append(values, string(r.next(int(r.uint32()))))
+		}
+		entry.Header[name] = values
+	}
+
+	entry.Body = r.next(int(r.uint32()))
+	if r.err != nil || r.remaining() != 0 {
+		return nil, ErrMalformedEntry
+	}
+
+	return entry, nil
+}
+
+//checkEntry tells if the value is an entry of the current version without decoding it.
+//Values of the older formats are left in the snapshots taken before the upgrade.
+func checkEntry(value []byte) error {
+	if len(value) <= len(entryMagic) || string(value[:len(entryMagic)]) != entryMagic {
+		return ErrMalformedEntry
+	}
+	if version := value[len(entryMagic)]; version != entryVersion {
+		return fmt.Errorf("unsupported cache entry version: %v", version)
+	}
+	return nil
+}
+
+//Age ...
+func (e *Entry) Age() int64 {
+	age := time.Now().Unix() - e.StoredAt
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+//SetValidators makes sure the response can be revalidated: ETag is generated from the body
+//and Last-Modified falls back to the response's date if the origin sends none
+func SetValidators(header http.Header, body []byte) {
+	if header.Get("ETag") == "" {
+		hash := fnv.New64a()
+		hash.Write(body) //nolint
+		header.Set("ETag", fmt.Sprintf(`"%x"`, hash.Sum64()))
+	}
+
+	if header.Get("Last-Modified") == "" {
+		lastModified := time.Now()
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			lastModified = date
+		}
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+//Strings longer than 64KB are cut, it's more than any header name, TTL or ETag takes
+func appendString16(b []byte, s string) []byte {
+	if len(s) > 0xffff {
+		s = s[:0xffff]
+	}
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+//entryReader reads the entry's fields one by one. The first error sticks, so the fields
+//are read without checks and the error is checked once in the end.
+type entryReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *entryReader) remaining() int {
+	return len(r.b) - r.off
+}
+
+func (r *entryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > r.remaining() {
+		r.err = ErrMalformedEntry
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *entryReader) uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *entryReader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *entryReader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *entryReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *entryReader) string16() string {
+	return string(r.next(int(r.uint16())))
+}
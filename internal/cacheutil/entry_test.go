@@ -0,0 +1,104 @@
+package cacheutil
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//header builds the header out of "Name: value" lines, a repeated name adds one more value
+func header(lines string) http.Header {
+	h := make(http.Header)
+	for _, line := range strings.Split(lines, "\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			h[name] = append(h[name], strings.TrimSpace(value))
+		}
+	}
+	return h
+}
+
+//equalEntries compares the entries the way they're served, nil and empty header, body or values are the same
+func equalEntries(a *Entry, b *Entry) bool {
+	normalize := func(e *Entry) Entry {
+		n := *e
+		if len(n.Body) == 0 {
+			n.Body = nil
+		}
+		n.Header = make(http.Header, len(e.Header))
+		for name, values := range e.Header {
+			if len(values) == 0 {
+				values = nil
+			}
+			n.Header[name] = values
+		}
+		return n
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+func FuzzEntryRoundTrip(f *testing.F) {
+	f.Add(uint16(200), int64(1700000000), "10.Minute", `"abc"`, int64(1690000000), int64(30), int64(600), "Content-Type: text/html", []byte("<html></html>"))
+	f.Add(uint16(200), int64(1700000000), "1.Hour", "", int64(0), int64(0), int64(0), "Set-Cookie: a=1; Path=/\nSet-Cookie: b=2; HttpOnly\nVary: Accept-Encoding\nVary: Accept-Language", []byte("body"))
+	f.Add(uint16(200), int64(0), "", "", int64(0), int64(0), int64(0), "", []byte{})
+	f.Add(uint16(200), int64(1700000000), "5.Second", `W/"1"`, int64(0), int64(0), int64(0), "Content-Type: application/octet-stream", []byte{0x00, 0xff, 0x42, 0x00, 0x0d, 0x0a, 0x0d, 0x0a})
+	f.Add(uint16(404), int64(1700000000), "1.Minute", "", int64(0), int64(0), int64(60), "Content-Type: text/plain\nCache-Control: max-age=60", []byte("not found"))
+	f.Add(uint16(301), int64(-1), "1.Day", "", int64(-1), int64(-1), int64(-1), "Location: /moved\nX-Empty:", []byte(nil))
+
+	f.Fuzz(func(t *testing.T, status uint16, storedAt int64, TTL string, etag string, lastModified int64, swr int64, sie int64, headers string, body []byte) {
+		//Strings over 64KB are cut by design
+		if len(TTL) > 0xffff || len(etag) > 0xffff {
+			t.Skip()
+		}
+		h := header(headers)
+		for name := range h {
+			if len(name) > 0xffff {
+				t.Skip()
+			}
+		}
+
+		entry := &Entry{
+			Status:               int(status),
+			Header:               h,
+			Body:                 body,
+			StoredAt:             storedAt,
+			TTL:                  TTL,
+			ETag:                 etag,
+			LastModified:         lastModified,
+			StaleWhileRevalidate: swr,
+			StaleIfError:         sie,
+		}
+
+		decoded, err := DecodeEntry(entry.Encode())
+		if err != nil {
+			t.Fatalf("failed to decode the entry: %v", err)
+		}
+		if !equalEntries(decoded, entry) {
+			t.Errorf("got %+v, want %+v", decoded, entry)
+		}
+	})
+}
+
+func FuzzDecodeEntry(f *testing.F) {
+	f.Add(NewEntry(200, header("Set-Cookie: a=1\nSet-Cookie: b=2"), []byte("body"), 1700000000, "1.Minute").Encode())
+	f.Add([]byte(entryMagic))
+	f.Add([]byte(entryMagic + "\x01"))
+	f.Add([]byte(entryMagic + "\x02\xff\xff\xff\xff\xff\xff\xff\xff"))
+	f.Add([]byte("Content-Type\x00text/html\x01StoredAt\x001700000000\x01\x02<html></html>"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, value []byte) {
+		entry, err := DecodeEntry(value)
+		if err != nil {
+			return
+		}
+		//Whatever is decoded must survive being stored again
+		decoded, err := DecodeEntry(entry.Encode())
+		if err != nil {
+			t.Fatalf("failed to decode the entry encoded again: %v", err)
+		}
+		if !equalEntries(decoded, entry) {
+			t.Errorf("got %+v, want %+v", decoded, entry)
+		}
+	})
+}
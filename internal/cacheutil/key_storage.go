@@ -38,3 +38,25 @@ func (ks *KeyStorage) GetInitialKey(hashedKey uint64) (string, error) {
 
 	return value, nil
 }
+
+//DeleteHashedKey ...
+func (ks *KeyStorage) DeleteHashedKey(hashedKey uint64) {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+
+	delete(ks.hashmap, hashedKey)
+}
+
+//Find returns the hashed keys whose initial keys match
+func (ks *KeyStorage) Find(match func(key string) bool) []uint64 {
+	ks.mux.RLock()
+	defer ks.mux.RUnlock()
+
+	var hashedKeys []uint64
+	for hashedKey, key := range ks.hashmap {
+		if match(key) {
+			hashedKeys = append(hashedKeys, hashedKey)
+		}
+	}
+	return hashedKeys
+}
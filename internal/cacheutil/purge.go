@@ -0,0 +1,168 @@
+package cacheutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/forwardutil"
+	"balansir/internal/logutil"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	//PurgeURL removes the URL's response with all its variants
+	PurgeURL = "url"
+	//PurgePrefix bans every URL starting with the prefix
+	PurgePrefix = "prefix"
+	//PurgeRegex bans every URL matching the regular expression
+	PurgeRegex = "regex"
+	//PurgeTag removes every response tagged with the surrogate key
+	PurgeTag = "tag"
+)
+
+var purgeKinds = []string{PurgeURL, PurgePrefix, PurgeRegex, PurgeTag}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+//PurgeHandler serves the cache purge API. It's turned off until config["cache"]["purge_token"]
+//is set, the token must be passed as a bearer one. The target is set with exactly one of the
+//url, prefix, regex or tag parameters. An absolute url or prefix targets its own host, a path
+//targets every host. The regex is matched against the host followed by the request URI.
+func PurgeHandler(w http.ResponseWriter, r *http.Request) {
+	configuration := configutil.GetConfig()
+	token := configuration.Cache.PurgeToken
+	cache := GetCluster()
+	if token == "" || !configuration.Cache.Enabled || cache == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != "PURGE" {
+		w.Header().Set("Allow", "POST, PURGE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		logutil.Warning(fmt.Sprintf("Unauthorized cache purge from %s", forwardutil.ClientIP(r)))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="balansir"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var kind, value string
+	for _, k := range purgeKinds {
+		if v := r.FormValue(k); v != "" {
+			if kind != "" {
+				http.Error(w, "only one purge target can be set at once", http.StatusBadRequest)
+				return
+			}
+			kind, value = k, v
+		}
+	}
+
+	var purged int
+	switch kind {
+	case PurgeURL:
+		u, err := url.Parse(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("malformed url: %v", err), http.StatusBadRequest)
+			return
+		}
+		purged = cache.Purge(strings.ToLower(u.Host) + u.RequestURI())
+	case PurgePrefix:
+		purged = cache.BanPrefix(value)
+	case PurgeRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("malformed regex: %v", err), http.StatusBadRequest)
+			return
+		}
+		purged = cache.BanRegex(re)
+	case PurgeTag:
+		purged = cache.PurgeTag(value)
+	default:
+		http.Error(w, fmt.Sprintf("purge target is missing. Use one of the following: %s", strings.Join(purgeKinds, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	logutil.Notice(fmt.Sprintf("Cache purge by %s (%s) from %s: %v entries removed", kind, value, forwardutil.ClientIP(r), purged))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&purgeResult{Purged: purged}); err != nil {
+		logutil.Warning(err)
+	}
+}
+
+//Purge removes the response of the key, all its variants included.
+//A key without the host, starting with "/", is removed on every host.
+func (cluster *CacheCluster) Purge(key string) int {
+	return cluster.remove(cluster.updater.keyStorage.Find(func(k string) bool {
+		return matchTarget(k, key) == key
+	}))
+}
+
+//BanPrefix removes the responses of the keys starting with the prefix. The scheme is ignored,
+//a prefix starting with "/" is matched against the request URI on every host.
+func (cluster *CacheCluster) BanPrefix(prefix string) int {
+	prefix = strings.TrimPrefix(strings.TrimPrefix(prefix, "http://"), "https://")
+	if i := strings.Index(prefix, "/"); i != 0 {
+		if i < 0 {
+			i = len(prefix)
+		}
+		prefix = strings.ToLower(prefix[:i]) + prefix[i:]
+	}
+	return cluster.remove(cluster.updater.keyStorage.Find(func(k string) bool {
+		return strings.HasPrefix(matchTarget(k, prefix), prefix)
+	}))
+}
+
+//BanRegex removes the responses of the keys matching the regular expression
+func (cluster *CacheCluster) BanRegex(re *regexp.Regexp) int {
+	return cluster.remove(cluster.updater.keyStorage.Find(func(k string) bool {
+		return re.MatchString(primaryKey(k))
+	}))
+}
+
+//PurgeTag removes the responses tagged with the surrogate key
+func (cluster *CacheCluster) PurgeTag(tag string) int {
+	return cluster.remove(cluster.tags.GetHashedKeys(tag))
+}
+
+//remove deletes the entries from their shards and forgets their keys
+func (cluster *CacheCluster) remove(hashedKeys []uint64) int {
+	var removed int
+	for _, hashedKey := range hashedKeys {
+		if cluster.delete(hashedKey) {
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		atomic.AddInt64(&cluster.Purges, int64(removed))
+		cluster.backupManager.Hit()
+	}
+	return removed
+}
+
+//GetPurges returns the number of entries removed through the purge API
+func (cluster *CacheCluster) GetPurges() int64 {
+	return atomic.LoadInt64(&cluster.Purges)
+}
+
+//matchTarget returns the part of the key a purge target is compared to,
+//the request URI alone for targets starting with "/", the whole primary key otherwise
+func matchTarget(key string, target string) string {
+	if strings.HasPrefix(target, "/") {
+		_, requestURI := splitKey(key)
+		return requestURI
+	}
+	return primaryKey(key)
+}
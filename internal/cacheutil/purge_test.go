@@ -0,0 +1,71 @@
+package cacheutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchTarget(t *testing.T) {
+	variant := "example.com/page?a=1" + varySeparator + "Accept-Encoding:gzip"
+
+	tests := []struct {
+		name   string
+		key    string
+		target string
+		want   string
+	}{
+		{name: "bare path target", key: "example.com/page?a=1", target: "/page?a=1", want: "/page?a=1"},
+		{name: "bare path target on another host", key: "other.org/page?a=1", target: "/page?a=1", want: "/page?a=1"},
+		{name: "bare path target on variant", key: variant, target: "/page?a=1", want: "/page?a=1"},
+		{name: "host target", key: "example.com/page?a=1", target: "example.com/page?a=1", want: "example.com/page?a=1"},
+		{name: "host target on variant", key: variant, target: "example.com/page?a=1", want: "example.com/page?a=1"},
+		{name: "root of host", key: "example.com", target: "/", want: "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchTarget(tt.key, tt.target); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeMatching(t *testing.T) {
+	keys := []string{
+		"example.com/page",
+		"example.com/page" + varySeparator + "Accept-Encoding:gzip",
+		"example.com/pages/1",
+		"other.org/page",
+		"example.com/static/app.js",
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		prefix bool
+		want   []bool
+	}{
+		{name: "url on its host", target: "example.com/page", want: []bool{true, true, false, false, false}},
+		{name: "path on every host", target: "/page", want: []bool{true, true, false, true, false}},
+		{name: "prefix on its host", target: "example.com/page", prefix: true, want: []bool{true, true, true, false, false}},
+		{name: "path prefix on every host", target: "/static/", prefix: true, want: []bool{false, false, false, false, true}},
+		{name: "host prefix", target: "other.org", prefix: true, want: []bool{false, false, false, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, key := range keys {
+				var got bool
+				if tt.prefix {
+					got = strings.HasPrefix(matchTarget(key, tt.target), tt.target)
+				} else {
+					got = matchTarget(key, tt.target) == tt.target
+				}
+				if got != tt.want[i] {
+					t.Errorf("key %q: got match %v, want %v", key, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package cacheutil
+
+import (
+	"balansir/internal/configutil"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//RulesMode caches every response matching the rules for the rule's TTL
+	RulesMode = "rules"
+	//RFCMode caches the responses the way RFC 9111 tells shared caches to
+	RFCMode = "rfc"
+
+	varySeparator = "\x00"
+)
+
+//Statuses that may be cached with no explicit freshness, see RFC 9110 section 15.1
+var heuristicStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+//ValidMode reports whether the cache mode is known, empty one stands for rules mode
+func ValidMode(mode string) bool {
+	switch mode {
+	case "", RulesMode, RFCMode:
+		return true
+	}
+	return false
+}
+
+//Key returns the cache key of the request, its target URI without the scheme.
+//Routes are dispatched by host, so the host is a part of the key.
+func Key(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+//splitKey returns the host and the request URI the key is made of
+func splitKey(key string) (string, string) {
+	key = primaryKey(key)
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i:]
+	}
+	return key, "/"
+}
+
+//GetRule returns the first rule the path starts with
+func GetRule(path string, rules []*configutil.Rule) *configutil.Rule {
+	for _, rule := range rules {
+		if strings.HasPrefix(path, rule.Path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+//CacheControl holds the Cache-Control directives with lowercased names
+type CacheControl map[string]string
+
+//ParseCacheControl ...
+func ParseCacheControl(header http.Header) CacheControl {
+	cc := make(CacheControl)
+	for _, val := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(val, ",") {
+			kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			if kv[0] == "" {
+				continue
+			}
+			var arg string
+			if len(kv) == 2 {
+				arg = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+			cc[strings.ToLower(kv[0])] = arg
+		}
+	}
+	return cc
+}
+
+//Has ...
+func (cc CacheControl) Has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+//Seconds returns the directive's delta-seconds argument
+func (cc CacheControl) Seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || seconds < 0 {
+		//Invalid value must be treated as stale
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+//Lookupable reports whether the request may be answered from the cache in rfc mode.
+//Clients asking for an end-to-end reload go to the origin.
+func Lookupable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	cc := ParseCacheControl(r.Header)
+	if cc.Has("no-cache") || cc.Has("no-store") {
+		return false
+	}
+	if maxAge, ok := cc.Seconds("max-age"); ok && maxAge == 0 {
+		return false
+	}
+	if len(cc) == 0 && strings.EqualFold(r.Header.Get("Pragma"), "no-cache") {
+		return false
+	}
+	return true
+}
+
+//Storable decides whether the response may be stored in rfc mode, for how long and
+//how old it's already. The origin's freshness lifetime wins over the rule's TTL,
+//unless the rule overrides it. Responses with no lifetime of their own are stored
+//for the rule's TTL if their status allows it, whether the rule overrides it or not.
+func Storable(r *http.Response, rule *configutil.Rule) (TTL string, age time.Duration, ok bool) {
+	if r.Request.Method != http.MethodGet || r.StatusCode == http.StatusPartialContent {
+		return "", 0, false
+	}
+
+	cc := ParseCacheControl(r.Header)
+	requestCC := ParseCacheControl(r.Request.Header)
+	//Responses that must be revalidated on every use aren't stored until revalidation is supported
+	if cc.Has("no-store") || cc.Has("private") || cc.Has("no-cache") || requestCC.Has("no-store") {
+		return "", 0, false
+	}
+	if len(r.Header.Values("Set-Cookie")) > 0 {
+		return "", 0, false
+	}
+	for _, name := range VaryHeaders(r.Header) {
+		if name == "*" {
+			return "", 0, false
+		}
+	}
+	if r.Request.Header.Get("Authorization") != "" && !cc.Has("public") && !cc.Has("s-maxage") && !cc.Has("must-revalidate") {
+		return "", 0, false
+	}
+
+	age = currentAge(r)
+
+	//Rule's TTL overrides the origin's lifetime only, it doesn't make uncacheable statuses cacheable
+	lifetime, explicit := freshnessLifetime(r, cc)
+	if !explicit && !heuristicStatuses[r.StatusCode] {
+		return "", 0, false
+	}
+	if !explicit || rule.Override {
+		return rule.TTL, age, true
+	}
+
+	//TTLs are kept with a second precision
+	remaining := int64((lifetime - age) / time.Second)
+	if remaining <= 0 {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%d.Second", remaining), age, true
+}
+
+func freshnessLifetime(r *http.Response, cc CacheControl) (time.Duration, bool) {
+	if sMaxAge, ok := cc.Seconds("s-maxage"); ok {
+		return sMaxAge, true
+	}
+	if maxAge, ok := cc.Seconds("max-age"); ok {
+		return maxAge, true
+	}
+
+	expiresHeader := r.Header.Get("Expires")
+	if expiresHeader == "" {
+		return 0, false
+	}
+	expires, err := http.ParseTime(expiresHeader)
+	if err != nil {
+		//Invalid date stands for the past
+		return 0, true
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	return expires.Sub(date), true
+}
+
+//currentAge is the age the response arrives with, either from its Age header or its Date
+func currentAge(r *http.Response) time.Duration {
+	var age time.Duration
+	if seconds, err := strconv.ParseInt(r.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+		if apparent := time.Since(date); apparent > age {
+			age = apparent
+		}
+	}
+	return age
+}
+
+//VaryHeaders returns the canonical names of the request headers the response varies on
+func VaryHeaders(header http.Header) []string {
+	var names []string
+	for _, val := range header.Values("Vary") {
+		for _, name := range strings.Split(val, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+//VariantKey appends the values of the vary headers to the key, so every variant gets its own entry
+func VariantKey(key string, names []string, r *http.Request) string {
+	if len(names) == 0 {
+		return key
+	}
+
+	var variant strings.Builder
+	variant.WriteString(key)
+	for _, name := range names {
+		variant.WriteString(varySeparator)
+		variant.WriteString(name)
+		variant.WriteString(":")
+		variant.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return variant.String()
+}
+
+func isVariantKey(key string) bool {
+	return strings.Contains(key, varySeparator)
+}
+
+//primaryKey strips the variant part off the key
+func primaryKey(key string) string {
+	if i := strings.Index(key, varySeparator); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
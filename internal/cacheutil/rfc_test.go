@@ -0,0 +1,185 @@
+package cacheutil
+
+import (
+	"balansir/internal/configutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newResponse(status int, headers string, request *http.Request) *http.Response {
+	if request == nil {
+		request, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	}
+	return &http.Response{StatusCode: status, Header: header(headers), Request: request}
+}
+
+func newCacheRequest(method string, headers string) *http.Request {
+	r, _ := http.NewRequest(method, "http://example.com/", nil)
+	r.Header = header(headers)
+	return r
+}
+
+//ttlSeconds reads the seconds out of the "N.Second" TTL
+func ttlSeconds(t *testing.T, TTL string) int64 {
+	seconds, err := strconv.ParseInt(strings.TrimSuffix(TTL, ".Second"), 10, 64)
+	if err != nil {
+		t.Fatalf("got TTL %q, want it in seconds", TTL)
+	}
+	return seconds
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now()
+	date := now.UTC().Format(http.TimeFormat)
+	expires := now.Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		headers      string
+		want         time.Duration
+		wantExplicit bool
+	}{
+		{name: "no lifetime", headers: "Content-Type: text/html"},
+		{name: "max-age", headers: "Cache-Control: max-age=60", want: time.Minute, wantExplicit: true},
+		{name: "s-maxage wins over max-age", headers: "Cache-Control: max-age=60, s-maxage=120", want: 2 * time.Minute, wantExplicit: true},
+		{name: "max-age wins over Expires", headers: "Cache-Control: max-age=60\nDate: " + date + "\nExpires: " + expires, want: time.Minute, wantExplicit: true},
+		{name: "s-maxage wins over Expires", headers: "Cache-Control: s-maxage=30\nDate: " + date + "\nExpires: " + expires, want: 30 * time.Second, wantExplicit: true},
+		{name: "Expires relative to Date", headers: "Date: " + date + "\nExpires: " + expires, want: time.Hour, wantExplicit: true},
+		{name: "invalid Expires is in the past", headers: "Expires: 0", wantExplicit: true},
+		{name: "invalid max-age is stale", headers: "Cache-Control: max-age=-1", wantExplicit: true},
+		{name: "quoted max-age", headers: `Cache-Control: max-age="60"`, want: time.Minute, wantExplicit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newResponse(http.StatusOK, tt.headers, nil)
+			got, explicit := freshnessLifetime(r, ParseCacheControl(r.Header))
+			if got != tt.want || explicit != tt.wantExplicit {
+				t.Errorf("got %v explicit %v, want %v explicit %v", got, explicit, tt.want, tt.wantExplicit)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	rule := &configutil.Rule{Path: "/", TTL: "10.Minute"}
+	override := &configutil.Rule{Path: "/", TTL: "10.Minute", Override: true}
+	tenSecondsAgo := time.Now().Add(-10 * time.Second).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		status  int
+		headers string
+		request *http.Request
+		rule    *configutil.Rule
+		wantOk  bool
+		//Rule's TTL is compared as is, origin's lifetime is compared in seconds
+		wantTTL     string
+		wantSeconds int64
+	}{
+		{name: "heuristic status takes rule TTL", status: http.StatusOK, rule: rule, wantOk: true, wantTTL: "10.Minute"},
+		{name: "non-heuristic status without lifetime", status: http.StatusFound, rule: rule},
+		{name: "non-heuristic status with lifetime", status: http.StatusFound, headers: "Cache-Control: max-age=60", rule: rule, wantOk: true, wantSeconds: 60},
+		{name: "origin lifetime wins over rule", status: http.StatusOK, headers: "Cache-Control: max-age=60", rule: rule, wantOk: true, wantSeconds: 60},
+		{name: "override rule wins over origin", status: http.StatusOK, headers: "Cache-Control: max-age=60", rule: override, wantOk: true, wantTTL: "10.Minute"},
+		{name: "override doesn't make status cacheable", status: http.StatusFound, rule: override},
+		{name: "no-store", status: http.StatusOK, headers: "Cache-Control: no-store, max-age=60", rule: rule},
+		{name: "private", status: http.StatusOK, headers: "Cache-Control: private, max-age=60", rule: rule},
+		{name: "no-cache", status: http.StatusOK, headers: "Cache-Control: no-cache", rule: rule},
+		{name: "request no-store", status: http.StatusOK, headers: "Cache-Control: max-age=60", request: newCacheRequest(http.MethodGet, "Cache-Control: no-store"), rule: rule},
+		{name: "Set-Cookie", status: http.StatusOK, headers: "Cache-Control: max-age=60\nSet-Cookie: a=1", rule: rule},
+		{name: "Vary *", status: http.StatusOK, headers: "Cache-Control: max-age=60\nVary: Accept-Encoding, *", rule: rule},
+		{name: "Vary on headers", status: http.StatusOK, headers: "Cache-Control: max-age=60\nVary: Accept-Encoding", rule: rule, wantOk: true, wantSeconds: 60},
+		{name: "Authorization without public", status: http.StatusOK, headers: "Cache-Control: max-age=60", request: newCacheRequest(http.MethodGet, "Authorization: Bearer t"), rule: rule},
+		{name: "Authorization with public", status: http.StatusOK, headers: "Cache-Control: public, max-age=60", request: newCacheRequest(http.MethodGet, "Authorization: Bearer t"), rule: rule, wantOk: true, wantSeconds: 60},
+		{name: "Authorization with s-maxage", status: http.StatusOK, headers: "Cache-Control: s-maxage=60", request: newCacheRequest(http.MethodGet, "Authorization: Bearer t"), rule: rule, wantOk: true, wantSeconds: 60},
+		{name: "POST", status: http.StatusOK, headers: "Cache-Control: max-age=60", request: newCacheRequest(http.MethodPost, ""), rule: rule},
+		{name: "partial content", status: http.StatusPartialContent, headers: "Cache-Control: max-age=60", rule: rule},
+		{name: "Age is subtracted", status: http.StatusOK, headers: "Cache-Control: max-age=60\nAge: 15", rule: rule, wantOk: true, wantSeconds: 45},
+		{name: "Date is subtracted", status: http.StatusOK, headers: "Cache-Control: max-age=60\nDate: " + tenSecondsAgo, rule: rule, wantOk: true, wantSeconds: 50},
+		{name: "older of Age and Date is taken", status: http.StatusOK, headers: "Cache-Control: max-age=60\nAge: 30\nDate: " + tenSecondsAgo, rule: rule, wantOk: true, wantSeconds: 30},
+		{name: "already expired", status: http.StatusOK, headers: "Cache-Control: max-age=60\nAge: 60", rule: rule},
+		{name: "invalid Expires", status: http.StatusOK, headers: "Expires: 0", rule: rule},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			TTL, _, ok := Storable(newResponse(tt.status, tt.headers, tt.request), tt.rule)
+			if ok != tt.wantOk {
+				t.Fatalf("got storable %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if tt.wantTTL != "" {
+				if TTL != tt.wantTTL {
+					t.Errorf("got TTL %q, want %q", TTL, tt.wantTTL)
+				}
+				return
+			}
+			//Date has a second precision, so the age taken from it may be a second older
+			if got := ttlSeconds(t, TTL); got > tt.wantSeconds || got < tt.wantSeconds-1 {
+				t.Errorf("got TTL of %v seconds, want %v", got, tt.wantSeconds)
+			}
+		})
+	}
+}
+
+func TestLookupable(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers string
+		want    bool
+	}{
+		{name: "GET", method: http.MethodGet, want: true},
+		{name: "HEAD", method: http.MethodHead, want: true},
+		{name: "POST", method: http.MethodPost},
+		{name: "no-cache", method: http.MethodGet, headers: "Cache-Control: no-cache"},
+		{name: "no-store", method: http.MethodGet, headers: "Cache-Control: no-store"},
+		{name: "max-age=0", method: http.MethodGet, headers: "Cache-Control: max-age=0"},
+		{name: "max-age", method: http.MethodGet, headers: "Cache-Control: max-age=60", want: true},
+		{name: "Pragma no-cache", method: http.MethodGet, headers: "Pragma: no-cache"},
+		{name: "Cache-Control wins over Pragma", method: http.MethodGet, headers: "Pragma: no-cache\nCache-Control: max-age=60", want: true},
+		{name: "Authorization", method: http.MethodGet, headers: "Authorization: Bearer t", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Lookupable(newCacheRequest(tt.method, tt.headers)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		headers string
+		want    string
+	}{
+		{name: "no vary", headers: "Accept-Encoding: gzip", want: "example.com/"},
+		{name: "single header", names: []string{"Accept-Encoding"}, headers: "Accept-Encoding: gzip", want: "example.com/\x00Accept-Encoding:gzip"},
+		{name: "missing header", names: []string{"Accept-Encoding"}, want: "example.com/\x00Accept-Encoding:"},
+		{name: "repeated header", names: []string{"Accept-Language"}, headers: "Accept-Language: en\nAccept-Language: de", want: "example.com/\x00Accept-Language:en,de"},
+		{name: "several headers", names: []string{"Accept-Encoding", "Accept-Language"}, headers: "Accept-Encoding: br\nAccept-Language: en", want: "example.com/\x00Accept-Encoding:br\x00Accept-Language:en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newCacheRequest(http.MethodGet, tt.headers)
+			got := VariantKey(Key(r), tt.names, r)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if primaryKey(got) != Key(r) {
+				t.Errorf("got primary key %q, want %q", primaryKey(got), Key(r))
+			}
+		})
+	}
+}
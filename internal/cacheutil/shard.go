@@ -19,9 +19,11 @@ type Shard struct {
 }
 
 type shardItem struct {
-	Index  int
-	Length int
-	TTL    int64
+	Index   int
+	Length  int
+	TTL     int64
+	Grace   int64
+	Expired bool
 }
 
 //CreateShard ...
@@ -38,12 +40,17 @@ func CreateShard(size int, CachePolicy string) *Shard {
 	return s
 }
 
-func (s *Shard) set(hashedKey uint64, value []byte, TTL string) {
+func (s *Shard) set(hashedKey uint64, value []byte, TTL string, grace int64) {
+	//Replaced value must not be left behind in the items, its key and tags stay
+	if item, ok := s.Hashmap[hashedKey]; ok {
+		s.free(hashedKey, item.Index, item.Length)
+	}
+
 	index := s.push(value)
 	duration := getDuration(TTL)
 	ttl := time.Now().Add(duration).Unix()
 
-	s.Hashmap[hashedKey] = shardItem{Index: index, Length: len(value), TTL: ttl}
+	s.Hashmap[hashedKey] = shardItem{Index: index, Length: len(value), TTL: ttl, Grace: grace}
 	s.Policy.push(index, hashedKey, TTL)
 }
 
@@ -69,12 +76,48 @@ func (s *Shard) get(hashedKey uint64) ([]byte, error) {
 	if !ok {
 		return nil, errors.New("key not found")
 	}
+	//Entry is kept past its expiration for the stale serving only
+	if time.Now().Unix() > s.expiresAt(hashedKey, item) {
+		return nil, errors.New("key expired")
+	}
 
 	value := s.Items[item.Index]
 	return value, nil
 }
 
+//getStale returns the value with its expiration time, whether it's fresh or stale
+func (s *Shard) getStale(hashedKey uint64) ([]byte, int64, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	item, ok := s.Hashmap[hashedKey]
+	if !ok {
+		return nil, 0, errors.New("key not found")
+	}
+
+	return s.Items[item.Index], s.expiresAt(hashedKey, item), nil
+}
+
+//Time based policies prolong the entries on every hit
+func (s *Shard) expiresAt(hashedKey uint64, item shardItem) int64 {
+	if !s.Policy.TimeBased() {
+		return item.TTL
+	}
+
+	s.Policy.mux.RLock()
+	defer s.Policy.mux.RUnlock()
+	return s.Policy.HashMap[hashedKey].Value
+}
+
+//delete removes the entry, whether it's purged, evicted or expired, and forgets its key and tags
 func (s *Shard) delete(keyIndex uint64, itemIndex int, valueSize int) {
+	s.free(keyIndex, itemIndex, valueSize)
+	if cluster := GetCluster(); cluster != nil {
+		cluster.forget(keyIndex)
+	}
+}
+
+func (s *Shard) free(keyIndex uint64, itemIndex int, valueSize int) {
 	delete(s.Hashmap, keyIndex)
 	delete(s.Items, itemIndex)
 
@@ -85,6 +128,8 @@ func (s *Shard) delete(keyIndex uint64, itemIndex int, valueSize int) {
 	s.CurrentSize -= valueSize
 }
 
+//update removes the expired entries, the ones with a grace period are kept until it's over.
+//Background update queues the refresh of every entry once it expires.
 func (s *Shard) update(timestamp int64, updater *Updater) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -92,33 +137,38 @@ func (s *Shard) update(timestamp int64, updater *Updater) {
 		return
 	}
 
-	for keyIndex := range s.Hashmap {
-		ttl := s.Hashmap[keyIndex].TTL
-
-		if s.Policy.TimeBased() {
-			ttl = s.Policy.HashMap[keyIndex].Value
+	cluster := GetCluster()
+	for keyIndex, item := range s.Hashmap {
+		expiresAt := s.expiresAt(keyIndex, item)
+		if timestamp <= expiresAt {
+			continue
 		}
 
-		if timestamp <= ttl {
-			return
-		}
-
-		s.delete(keyIndex, s.Hashmap[keyIndex].Index, s.Hashmap[keyIndex].Length)
-
-		cluster := GetCluster()
-		cluster.backupManager.Hit()
-
-		if cluster.backgroundUpdate && updater != nil {
-			urlString, err := updater.keyStorage.GetInitialKey(keyIndex)
-			if err != nil {
+		value := s.Items[item.Index]
+		//Entries kept for the grace period are refreshed once, as soon as they expire
+		refresh := !item.Expired && cluster.backgroundUpdate && updater != nil
+		//Key and tags are forgotten along with the deleted entry, so they're taken beforehand
+		var urlString string
+		var tags []string
+		if refresh {
+			var err error
+			if urlString, err = updater.keyStorage.GetInitialKey(keyIndex); err != nil {
 				logutil.Warning(err)
-				continue
+				refresh = false
 			}
+			tags = cluster.tags.GetTags(keyIndex)
+		}
 
-			err = updater.InvalidateCachedResponse(urlString, &s.mux)
-			if err != nil {
-				logutil.Error(err)
-			}
+		//Variants can't be refetched without the client's headers, they're stored again on the next request.
+		//Entry the refresh isn't queued for is retried on the next tick while it's kept.
+		queued := !refresh || isVariantKey(urlString) || updater.Revalidate(urlString, value, nil, tags)
+
+		if timestamp > expiresAt+item.Grace {
+			s.delete(keyIndex, item.Index, item.Length)
+			cluster.backupManager.Hit()
+		} else if queued {
+			item.Expired = true
+			s.Hashmap[keyIndex] = item
 		}
 	}
 }
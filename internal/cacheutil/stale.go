@@ -0,0 +1,167 @@
+package cacheutil
+
+import (
+	"balansir/internal/configutil"
+	"net/http"
+	"time"
+)
+
+//StaleWindows returns the stale-while-revalidate and stale-if-error windows of the response in seconds.
+//In rfc mode the origin's Cache-Control extensions win over the rule's windows, unless the rule
+//overrides them. Responses that must be revalidated are never served stale in rfc mode.
+func StaleWindows(r *http.Response, rule *configutil.Rule, rfc bool) (swr int64, sie int64) {
+	swr, sie = getWindow(rule.StaleWhileRevalidate), getWindow(rule.StaleIfError)
+	if !rfc || rule.Override {
+		return swr, sie
+	}
+
+	cc := ParseCacheControl(r.Header)
+	if cc.Has("must-revalidate") || cc.Has("proxy-revalidate") {
+		return 0, 0
+	}
+	if window, ok := cc.Seconds("stale-while-revalidate"); ok {
+		swr = int64(window / time.Second)
+	}
+	if window, ok := cc.Seconds("stale-if-error"); ok {
+		sie = int64(window / time.Second)
+	}
+	return swr, sie
+}
+
+//Unlike TTL, missing window means there is none
+func getWindow(window string) int64 {
+	if window == "" {
+		return 0
+	}
+	return int64(getDuration(window) / time.Second)
+}
+
+//Grace is how long the entry is kept after it expires
+func (e *Entry) Grace() int64 {
+	if e.StaleWhileRevalidate > e.StaleIfError {
+		return e.StaleWhileRevalidate
+	}
+	return e.StaleIfError
+}
+
+//GetStale returns the value along with the time it expires at, whether it's fresh or stale
+func (cluster *CacheCluster) GetStale(key string) ([]byte, int64, error) {
+	hashedKey := cluster.Hash.Sum(key)
+	value, expiresAt, err := cluster.getShard(hashedKey).getStale(hashedKey)
+	if err == nil {
+		if err = checkEntry(value); err != nil {
+			cluster.delete(hashedKey)
+		}
+	}
+	return value, expiresAt, err
+}
+
+//getStaleEntry returns the entry with its value if it's still within the window picked out of it
+func (cluster *CacheCluster) getStaleEntry(key string, window func(*Entry) int64) (*Entry, []byte) {
+	value, expiresAt, err := cluster.GetStale(key)
+	if err != nil {
+		return nil, nil
+	}
+	entry, err := DecodeEntry(value)
+	if err != nil || time.Now().Unix() > expiresAt+window(entry) {
+		return nil, nil
+	}
+	return entry, value
+}
+
+//serveStale answers with the expired response within its stale-while-revalidate window,
+//while a single background request refreshes it
+func (cluster *CacheCluster) serveStale(w http.ResponseWriter, r *http.Request, key string, variantKey string) bool {
+	entry, value := cluster.getStaleEntry(variantKey, func(e *Entry) int64 { return e.StaleWhileRevalidate })
+	if entry == nil {
+		return false
+	}
+
+	//Variant is refreshed with the client's values of the headers it varies on
+	header := make(http.Header)
+	for _, name := range cluster.vary.GetHeaders(cluster.Hash.Sum(key)) {
+		header[name] = r.Header.Values(name)
+	}
+	cluster.updater.Revalidate(variantKey, value, header, nil)
+
+	cluster.hit()
+	serveEntry(w, r, entry, "STALE")
+	return true
+}
+
+//StaleIfError makes the writer answer with the expired response instead of a server error,
+//as long as the response's stale-if-error window is open
+func StaleIfError(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return w
+	}
+	if r.Header.Get("X-Balansir-Background-Update") != "" {
+		return w
+	}
+
+	configuration := configutil.GetConfig()
+	cache := GetCluster()
+	if cache == nil || GetRule(r.URL.Path, configuration.Cache.Rules) == nil {
+		return w
+	}
+	if configuration.Cache.Mode == RFCMode && !Lookupable(r) {
+		return w
+	}
+
+	key := Key(r)
+	entry, _ := cache.getStaleEntry(cache.VariantKey(key, r), func(e *Entry) int64 { return e.StaleIfError })
+	if entry == nil {
+		return w
+	}
+	return &staleWriter{ResponseWriter: w, r: r, entry: entry}
+}
+
+type staleWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	entry       *Entry
+	wroteHeader bool
+	stale       bool
+}
+
+func (sw *staleWriter) WriteHeader(status int) {
+	if sw.stale {
+		return
+	}
+	//Informational responses are passed through
+	if sw.wroteHeader || status < http.StatusOK {
+		sw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	sw.wroteHeader = true
+
+	if status < http.StatusInternalServerError {
+		sw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	//Headers of the error response must not leak into the stale one
+	header := sw.ResponseWriter.Header()
+	for key := range header {
+		delete(header, key)
+	}
+	sw.stale = true
+	GetCluster().hit()
+	serveEntry(sw.ResponseWriter, sw.r, sw.entry, "STALE")
+}
+
+func (sw *staleWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	//Error response's body is dropped
+	if sw.stale {
+		return len(b), nil
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+//Unwrap lets http.ResponseController reach the underlying writer
+func (sw *staleWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,54 @@
+package cacheutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStaleWriter(t *testing.T) {
+	previous := cluster
+	cluster = &CacheCluster{}
+	defer func() { cluster = previous }()
+
+	tests := []struct {
+		name        string
+		status      int
+		wantStatus  int
+		wantBody    string
+		wantXCache  string
+		wantErrorID bool
+	}{
+		{name: "server error turns stale", status: http.StatusBadGateway, wantStatus: http.StatusOK, wantBody: "stale", wantXCache: "STALE"},
+		{name: "internal error turns stale", status: http.StatusInternalServerError, wantStatus: http.StatusOK, wantBody: "stale", wantXCache: "STALE"},
+		{name: "success is passed through", status: http.StatusOK, wantStatus: http.StatusOK, wantBody: "origin", wantErrorID: true},
+		{name: "client error is passed through", status: http.StatusNotFound, wantStatus: http.StatusNotFound, wantBody: "origin", wantErrorID: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := NewEntry(http.StatusOK, header("Content-Type: text/plain"), []byte("stale"), time.Now().Unix()-60, "1.Second")
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+			rec := httptest.NewRecorder()
+			sw := &staleWriter{ResponseWriter: rec, r: r, entry: entry}
+
+			sw.Header().Set("X-Error-Id", "1")
+			sw.WriteHeader(tt.status)
+			sw.Write([]byte("origin"))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %v, want %v", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("got body %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("X-Cache"); got != tt.wantXCache {
+				t.Errorf("got X-Cache %q, want %q", got, tt.wantXCache)
+			}
+			if got := rec.Header().Get("X-Error-Id") != ""; got != tt.wantErrorID {
+				t.Errorf("got error response header kept %v, want %v", got, tt.wantErrorID)
+			}
+		})
+	}
+}
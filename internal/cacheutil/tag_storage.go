@@ -0,0 +1,114 @@
+package cacheutil
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//TagStorage keeps the surrogate keys of the cached responses and the responses of every key
+type TagStorage struct {
+	keys map[uint64][]string
+	tags map[string]map[uint64]bool
+	mux  sync.RWMutex
+}
+
+//NewTagStorage ...
+func NewTagStorage() *TagStorage {
+	return &TagStorage{
+		keys: make(map[uint64][]string),
+		tags: make(map[string]map[uint64]bool),
+	}
+}
+
+//SurrogateKeys returns the tags set by the backend in the space-separated Surrogate-Key
+//and comma-separated Cache-Tag headers
+func SurrogateKeys(header http.Header) []string {
+	var tags []string
+	for _, val := range header.Values("Surrogate-Key") {
+		tags = append(tags, strings.Fields(val)...)
+	}
+	for _, val := range header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(val, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+//SetTags replaces the tags of the hashed key
+func (ts *TagStorage) SetTags(hashedKey uint64, tags []string) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+
+	ts.delete(hashedKey)
+	if len(tags) == 0 {
+		return
+	}
+
+	ts.keys[hashedKey] = tags
+	for _, tag := range tags {
+		if ts.tags[tag] == nil {
+			ts.tags[tag] = make(map[uint64]bool)
+		}
+		ts.tags[tag][hashedKey] = true
+	}
+}
+
+//GetHashedKeys returns the hashed keys tagged with the tag
+func (ts *TagStorage) GetHashedKeys(tag string) []uint64 {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+
+	hashedKeys := make([]uint64, 0, len(ts.tags[tag]))
+	for hashedKey := range ts.tags[tag] {
+		hashedKeys = append(hashedKeys, hashedKey)
+	}
+	return hashedKeys
+}
+
+//GetTags returns the tags of the hashed key
+func (ts *TagStorage) GetTags(hashedKey uint64) []string {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+
+	return ts.keys[hashedKey]
+}
+
+//DeleteHashedKey ...
+func (ts *TagStorage) DeleteHashedKey(hashedKey uint64) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+
+	ts.delete(hashedKey)
+}
+
+func (ts *TagStorage) delete(hashedKey uint64) {
+	for _, tag := range ts.keys[hashedKey] {
+		delete(ts.tags[tag], hashedKey)
+		if len(ts.tags[tag]) == 0 {
+			delete(ts.tags, tag)
+		}
+	}
+	delete(ts.keys, hashedKey)
+}
+
+func (ts *TagStorage) snapshot() map[uint64][]string {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+
+	keys := make(map[uint64][]string, len(ts.keys))
+	for hashedKey, tags := range ts.keys {
+		keys[hashedKey] = tags
+	}
+	return keys
+}
+
+//restore rebuilds the storage from the tags of the hashed keys kept in the snapshot
+func (ts *TagStorage) restore(keys map[uint64][]string) {
+	for hashedKey, tags := range keys {
+		ts.SetTags(hashedKey, tags)
+	}
+}
@@ -0,0 +1,38 @@
+package cacheutil
+
+import (
+	"sync"
+)
+
+//VaryStorage keeps the headers the cached responses vary on by their keys
+type VaryStorage struct {
+	hashmap map[uint64][]string
+	mux     sync.RWMutex
+}
+
+//NewVaryStorage ...
+func NewVaryStorage() *VaryStorage {
+	return &VaryStorage{
+		hashmap: make(map[uint64][]string),
+	}
+}
+
+//SetHeaders ...
+func (vs *VaryStorage) SetHeaders(hashedKey uint64, names []string) {
+	vs.mux.Lock()
+	defer vs.mux.Unlock()
+
+	if len(names) == 0 {
+		delete(vs.hashmap, hashedKey)
+		return
+	}
+	vs.hashmap[hashedKey] = names
+}
+
+//GetHeaders ...
+func (vs *VaryStorage) GetHeaders(hashedKey uint64) []string {
+	vs.mux.RLock()
+	defer vs.mux.RUnlock()
+
+	return vs.hashmap[hashedKey]
+}
@@ -8,13 +8,15 @@ import (
 type Configuration struct {
 	Mux                sync.RWMutex
 	Guard              sync.WaitGroup
-	ServerList         []*Endpoint `yaml:"server_list"`
+	Upstream           `yaml:",inline"`
+	Upstreams          []*Upstream `yaml:"upstreams"`
+	Routes             []*Route    `yaml:"routes"`
+	Listeners          []*Listener `yaml:"listeners"`
 	Protocol           string      `yaml:"connection_protocol"`
 	SSLCertificate     string      `yaml:"ssl_certificate"`
 	SSLKey             string      `yaml:"ssl_private_key"`
 	Port               int         `yaml:"http_port"`
 	TLSPort            int         `yaml:"tls_port"`
-	Delay              int         `yaml:"server_check_timer"`
 	SessionPersistence bool        `yaml:"session_persistence"`
 	Autocert           bool        `yaml:"autocert"`
 	AutocertHosts      []string    `yaml:"autocert_hosts"`
@@ -23,21 +25,185 @@ type Configuration struct {
 	RateLimit          bool        `yaml:"rate_limit"`
 	RatePerSecond      int         `yaml:"rate_per_second"`
 	RateBucket         int         `yaml:"rate_bucket"`
-	Timeout            int         `yaml:"server_check_timeout"`
-	ReadTimeout        int         `yaml:"read_timeout"`
-	WriteTimeout       int         `yaml:"write_timeout"`
 	TransparentProxy   bool        `yaml:"transparent_proxy"`
-	Algorithm          string      `yaml:"balancing_algorithm"`
+	TrustedProxies     []string    `yaml:"trusted_proxies"`
+	AcceptProxy        AcceptProxy `yaml:"accept_proxy_protocol"`
 	Cache              Cache       `yaml:"cache"`
 	ServeStatic        bool        `yaml:"serve_static"`
 	StaticFolder       string      `yaml:"static_folder"`
 	StaticAlias        string      `yaml:"static_alias"`
 }
 
+//Upstream ...
+type Upstream struct {
+	Name                string              `yaml:"name"`
+	ServerList          []*Endpoint         `yaml:"server_list"`
+	Algorithm           string              `yaml:"balancing_algorithm"`
+	Delay               int                 `yaml:"server_check_timer"`
+	Timeout             int                 `yaml:"server_check_timeout"`
+	ReadTimeout         int                 `yaml:"read_timeout"`
+	WriteTimeout        int                 `yaml:"write_timeout"`
+	HealthCheck         HealthCheck         `yaml:"health_check"`
+	OutlierDetection    OutlierDetection    `yaml:"outlier_detection"`
+	CircuitBreaker      CircuitBreaker      `yaml:"circuit_breaker"`
+	Retry               Retry               `yaml:"retry"`
+	ConsistentHash      ConsistentHash      `yaml:"consistent_hash"`
+	SlowStart           SlowStart           `yaml:"slow_start"`
+	MinHealthyPercent   int                 `yaml:"min_healthy_percent"`
+	Queue               Queue               `yaml:"queue"`
+	AdaptiveConcurrency AdaptiveConcurrency `yaml:"adaptive_concurrency"`
+	Tunnel              Tunnel              `yaml:"tunnel"`
+	SendProxyProtocol   string              `yaml:"send_proxy_protocol"`
+}
+
+//AcceptProxy ...
+type AcceptProxy struct {
+	Enabled      bool     `yaml:"enabled"`
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
+}
+
+//Tunnel ...
+type Tunnel struct {
+	IdleTimeout int `yaml:"idle_timeout"`
+	MaxLifetime int `yaml:"max_lifetime"`
+}
+
+//SlowStart ...
+type SlowStart struct {
+	Window           int `yaml:"window"`
+	MinWeightPercent int `yaml:"min_weight_percent"`
+}
+
+//Queue ...
+type Queue struct {
+	Size       int `yaml:"size"`
+	Timeout    int `yaml:"timeout"`
+	RetryAfter int `yaml:"retry_after"`
+}
+
+//AdaptiveConcurrency ...
+type AdaptiveConcurrency struct {
+	Enabled      bool    `yaml:"enabled"`
+	InitialLimit int     `yaml:"initial_limit"`
+	MinLimit     int     `yaml:"min_limit"`
+	MaxLimit     int     `yaml:"max_limit"`
+	Window       int     `yaml:"window"`
+	Tolerance    float64 `yaml:"tolerance"`
+}
+
+//Listener ...
+type Listener struct {
+	Name        string `yaml:"name"`
+	Protocol    string `yaml:"protocol"`
+	Port        int    `yaml:"port"`
+	Upstream    string `yaml:"upstream"`
+	IdleTimeout int    `yaml:"idle_timeout"`
+	Mode        string `yaml:"mode"`
+	WaitReply   bool   `yaml:"wait_reply"`
+}
+
+//Route ...
+type Route struct {
+	Name       string            `yaml:"name"`
+	Host       string            `yaml:"host"`
+	PathPrefix string            `yaml:"path_prefix"`
+	PathRegex  string            `yaml:"path_regex"`
+	Methods    []string          `yaml:"methods"`
+	Headers    map[string]string `yaml:"headers"`
+	Upstream   string            `yaml:"upstream"`
+	Split      *Split            `yaml:"split"`
+	Mirror     *Mirror           `yaml:"mirror"`
+	Hedge      *Hedge            `yaml:"hedge"`
+}
+
+//Hedge ...
+type Hedge struct {
+	Delay         int `yaml:"delay"`
+	BudgetPercent int `yaml:"budget_percent"`
+	MinPerSecond  int `yaml:"min_per_second"`
+}
+
+//Mirror ...
+type Mirror struct {
+	Upstream      string  `yaml:"upstream"`
+	Percent       float64 `yaml:"percent"`
+	MaxBodySize   int64   `yaml:"max_body_size"`
+	MaxConcurrent int64   `yaml:"max_concurrent"`
+}
+
+//Split ...
+type Split struct {
+	Variants       []*Variant `yaml:"variants"`
+	Key            string     `yaml:"key"`
+	Name           string     `yaml:"name"`
+	OverrideHeader string     `yaml:"override_header"`
+	OverrideCookie string     `yaml:"override_cookie"`
+	CookieMaxAge   int        `yaml:"cookie_max_age"`
+}
+
+//Variant ...
+type Variant struct {
+	Upstream string `yaml:"upstream"`
+	Weight   int    `yaml:"weight"`
+}
+
 //Endpoint ...
 type Endpoint struct {
-	URL    string  `yaml:"endpoint"`
-	Weight float64 `yaml:"weight"`
+	URL            string  `yaml:"endpoint"`
+	Weight         float64 `yaml:"weight"`
+	Priority       int     `yaml:"priority"`
+	MaxConnections int     `yaml:"max_connections"`
+	MaxRequests    int     `yaml:"max_requests"`
+}
+
+//HealthCheck ...
+type HealthCheck struct {
+	Type               string            `yaml:"type"`
+	Method             string            `yaml:"method"`
+	Path               string            `yaml:"path"`
+	Headers            map[string]string `yaml:"headers"`
+	ExpectedStatus     []string          `yaml:"expected_status"`
+	BodyMatch          string            `yaml:"body_match"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	Rise               int               `yaml:"rise"`
+	Fall               int               `yaml:"fall"`
+}
+
+//OutlierDetection ...
+type OutlierDetection struct {
+	Enabled            bool `yaml:"enabled"`
+	Consecutive5xx     int  `yaml:"consecutive_5xx"`
+	ConsecutiveErrors  int  `yaml:"consecutive_errors"`
+	BaseEjectionTime   int  `yaml:"base_ejection_time"`
+	MaxEjectionTime    int  `yaml:"max_ejection_time"`
+	MaxEjectionPercent int  `yaml:"max_ejection_percent"`
+}
+
+//CircuitBreaker ...
+type CircuitBreaker struct {
+	Enabled          bool `yaml:"enabled"`
+	Window           int  `yaml:"window"`
+	MinRequests      int  `yaml:"min_requests"`
+	ErrorRate        int  `yaml:"error_rate"`
+	LatencyThreshold int  `yaml:"latency_threshold"`
+	SlowRate         int  `yaml:"slow_rate"`
+	OpenTimeout      int  `yaml:"open_timeout"`
+	HalfOpenRequests int  `yaml:"half_open_requests"`
+}
+
+//Retry ...
+type Retry struct {
+	Enabled             bool  `yaml:"enabled"`
+	MaxRetries          int   `yaml:"max_retries"`
+	BudgetPercent       int   `yaml:"budget_percent"`
+	MinRetriesPerSecond int   `yaml:"min_retries_per_second"`
+	MaxBodySize         int64 `yaml:"max_body_size"`
+}
+
+//ConsistentHash ...
+type ConsistentHash struct {
+	Key  string `yaml:"key"`
+	Name string `yaml:"name"`
 }
 
 //Cache ...
@@ -47,13 +213,18 @@ type Cache struct {
 	ShardSize        int     `yaml:"shard_size"`
 	Policy           string  `yaml:"policy"`
 	BackgroundUpdate bool    `yaml:"background_update"`
+	Mode             string  `yaml:"mode"`
+	PurgeToken       string  `yaml:"purge_token"`
 	Rules            []*Rule `yaml:"rules"`
 }
 
 //Rule ...
 type Rule struct {
-	Path string `yaml:"path"`
-	TTL  string `yaml:"ttl"`
+	Path                 string `yaml:"path"`
+	TTL                  string `yaml:"ttl"`
+	Override             bool   `yaml:"override"`
+	StaleWhileRevalidate string `yaml:"stale_while_revalidate"`
+	StaleIfError         string `yaml:"stale_if_error"`
 }
 
 var config *Configuration
@@ -67,3 +238,32 @@ func GetConfig() *Configuration {
 
 	return config
 }
+
+//Update replaces the settings with the parsed ones. Settings missing in the parsed
+//configuration are reset, so keys removed from the file take effect.
+func (configuration *Configuration) Update(parsed *Configuration) {
+	configuration.Upstream = parsed.Upstream
+	configuration.Upstreams = parsed.Upstreams
+	configuration.Routes = parsed.Routes
+	configuration.Listeners = parsed.Listeners
+	configuration.Protocol = parsed.Protocol
+	configuration.SSLCertificate = parsed.SSLCertificate
+	configuration.SSLKey = parsed.SSLKey
+	configuration.Port = parsed.Port
+	configuration.TLSPort = parsed.TLSPort
+	configuration.SessionPersistence = parsed.SessionPersistence
+	configuration.Autocert = parsed.Autocert
+	configuration.AutocertHosts = parsed.AutocertHosts
+	configuration.SessionMaxAge = parsed.SessionMaxAge
+	configuration.GzipResponse = parsed.GzipResponse
+	configuration.RateLimit = parsed.RateLimit
+	configuration.RatePerSecond = parsed.RatePerSecond
+	configuration.RateBucket = parsed.RateBucket
+	configuration.TransparentProxy = parsed.TransparentProxy
+	configuration.TrustedProxies = parsed.TrustedProxies
+	configuration.AcceptProxy = parsed.AcceptProxy
+	configuration.Cache = parsed.Cache
+	configuration.ServeStatic = parsed.ServeStatic
+	configuration.StaticFolder = parsed.StaticFolder
+	configuration.StaticAlias = parsed.StaticAlias
+}
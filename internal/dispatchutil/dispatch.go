@@ -3,50 +3,165 @@ package dispatchutil
 import (
 	"balansir/internal/configutil"
 	"balansir/internal/helpers"
+	"balansir/internal/poolutil"
+	"balansir/internal/proxyprotoutil"
+	"balansir/internal/proxyutil"
 	"balansir/internal/rateutil"
 	"balansir/internal/serverutil"
+	"balansir/internal/tunnelutil"
+	"context"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"sync/atomic"
 	"time"
 )
 
+//ErrBreakerOpen ...
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+//UpstreamError ...
+type UpstreamError struct {
+	Err       error
+	Connected bool
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
 func setSecureHeaders(w http.ResponseWriter) http.ResponseWriter {
-	w.Header().Add("X-XSS-Protection", "1; mode=block")
-	w.Header().Add("X-Content-Type-Options", "nosniff")
-	w.Header().Add("X-Frame-Options", "deny")
+	w.Header().Set("X-XSS-Protection", "1; mode=block")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "deny")
 	return w
 }
 
-//Dispatch ...
-func Dispatch(endpoint *serverutil.Server, w http.ResponseWriter, r *http.Request) {
+//Dispatch proxies the request to the endpoint. If the endpoint fails before anything
+//is written to the client, the error is returned and the response is left to the caller.
+func Dispatch(pool *poolutil.ServerPool, endpoint *serverutil.Server, w http.ResponseWriter, r *http.Request) error {
 	configuration := configutil.GetConfig()
 	rateCounter := rateutil.GetRateCounter()
 
-	trackResponseTime := r.Header.Get("X-Balansir-Background-Update") == ""
+	//Trial slot might've been taken by a concurrent request while the server was being selected
+	if !endpoint.Breaker.Allow() {
+		return &UpstreamError{Err: ErrBreakerOpen}
+	}
+
+	trackResponseTime := r.Header.Get("X-Balansir-Background-Update") == "" && r.Header.Get(MirrorHeader) == ""
+	//Upgraded connections stay active until the tunnel is closed
+	tunnel := tunnelutil.IsUpgrade(r)
 	var requestStart time.Time
+	//0 – not connected, 1 – waiting for response, 2 – got response
+	var state int32
 
 	trace := &httptrace.ClientTrace{
 		GotConn: func(httptrace.GotConnInfo) {
+			//Transport may retry the request on another connection
+			if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+				return
+			}
 			endpoint.IncreaseActiveConnections()
+			requestStart = time.Now()
 			if trackResponseTime {
-				requestStart = time.Now()
 				rateCounter.HitRequest()
 			}
 		},
 		GotFirstResponseByte: func() {
-			endpoint.DecreaseActiveConnections()
+			if !atomic.CompareAndSwapInt32(&state, 1, 2) {
+				return
+			}
+			if !tunnel {
+				endpoint.DecreaseActiveConnections()
+			}
+			pool.ReportLatency(endpoint, time.Since(requestStart))
 			if trackResponseTime {
 				rateCounter.CommitResponseTime(requestStart)
 			}
 		},
 	}
 
+	//Server's transport doesn't keep the connections then, so every request is sent with its own client's header
+	if version := pool.GetUpstream().SendProxyProtocol; version != "" {
+		localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		r = r.WithContext(proxyprotoutil.WithHeader(r.Context(), version, proxyprotoutil.ParseAddr(r.RemoteAddr), localAddr))
+	}
+
 	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
-	w = setSecureHeaders(w)
+	r, attempt := proxyutil.WithAttempt(r)
+	w = setSecureHeaders(tunnelutil.Wrap(w, tunnelutil.GetSettings(&pool.GetUpstream().Tunnel)))
 
 	if configuration.SessionPersistence {
 		w = helpers.SetSession(w, endpoint.ServerHash, configuration.SessionMaxAge)
 	}
 
 	endpoint.Proxy.ServeHTTP(w, r)
+
+	connected := atomic.LoadInt32(&state) > 0
+	//Connection failed before the first byte of the response, so it must be released here
+	if atomic.CompareAndSwapInt32(&state, 1, 2) || tunnel && connected {
+		endpoint.DecreaseActiveConnections()
+	}
+
+	if attempt.Err != nil {
+		return &UpstreamError{Err: attempt.Err, Connected: connected}
+	}
+	return nil
+}
+
+const (
+	//MirrorHeader marks shadow copies of the requests
+	MirrorHeader = "X-Balansir-Mirror"
+	//Shadow requests must end at some point even if the shadow pool has no timeout
+	defaultMirrorTimeout = 30 * time.Second
+)
+
+//NewMirrorRequest copies the request for the shadow pool. The copy is detached
+//from the client's connection, so it can outlive the original request.
+func NewMirrorRequest(r *http.Request, body []byte, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	mirror := r.Clone(ctx)
+	mirror.Header.Set(MirrorHeader, "1")
+	helpers.ResetRequestBody(mirror, body)
+	return mirror, cancel
+}
+
+//Mirror dispatches the shadow request, discarding the response. Returns the response status code.
+func Mirror(pool *poolutil.ServerPool, endpoint *serverutil.Server, r *http.Request) int {
+	w := &discardWriter{header: http.Header{}}
+	if err := Dispatch(pool, endpoint, w, r); err != nil {
+		return http.StatusBadGateway
+	}
+	return w.status
+}
+
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (dw *discardWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *discardWriter) Write(b []byte) (int, error) {
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (dw *discardWriter) WriteHeader(status int) {
+	if dw.status == 0 {
+		dw.status = status
+	}
 }
@@ -0,0 +1,55 @@
+package dispatchutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/poolutil"
+	"balansir/internal/proxyprotoutil"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDispatchProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	proxyprotoutil.SetTrusted([]*net.IPNet{loopback})
+	defer proxyprotoutil.SetTrusted(nil)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+	backend.Listener = proxyprotoutil.NewListener(backend.Listener, 0)
+	backend.Start()
+	defer backend.Close()
+
+	for _, version := range []string{proxyprotoutil.V1, proxyprotoutil.V2} {
+		t.Run(version, func(t *testing.T) {
+			upstream := &configutil.Upstream{
+				Name:              "proxy-protocol",
+				ServerList:        []*configutil.Endpoint{{URL: strings.TrimPrefix(backend.URL, "http://")}},
+				SendProxyProtocol: version,
+			}
+			pool, err := poolutil.RedefineServerPool(upstream, &poolutil.ServerPool{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//Clients take turns, so a reused connection would show the previous client's address
+			for _, client := range []string{"192.0.2.1:1001", "192.0.2.2:1002", "192.0.2.1:1003"} {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("192.0.2.100"), Port: 80}))
+				r.RemoteAddr = client
+				w := httptest.NewRecorder()
+				if err := Dispatch(pool, pool.ServerList[0], w, r); err != nil {
+					t.Fatal(err)
+				}
+				if got := w.Body.String(); got != client {
+					t.Errorf("got client %v, want %v", got, client)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package forwardutil
+
+import (
+	"balansir/internal/helpers"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"}
+
+var trusted []*net.IPNet
+var mux sync.RWMutex
+
+//SetTrustedProxies replaces the proxies whose forwarding headers are kept
+func SetTrustedProxies(nets []*net.IPNet) {
+	mux.Lock()
+	defer mux.Unlock()
+	trusted = nets
+}
+
+func trustedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	mux.RLock()
+	defer mux.RUnlock()
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//ClientIP resolves the real client's IP. Forwarding headers are only believed when the request
+//comes from a trusted proxy: the chain is walked from the right and the first address that
+//doesn't belong to a trusted proxy is the client.
+func ClientIP(r *http.Request) string {
+	peer := helpers.ReturnIPFromHost(r.RemoteAddr)
+	if !trustedIP(net.ParseIP(peer)) {
+		return peer
+	}
+
+	client := peer
+	chain := forwardedFor(r.Header)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		//Garbage in the chain can't be trusted any further, the last trusted proxy
+		//that passed it on is as close to the client as it gets
+		if ip == nil {
+			break
+		}
+		client = chain[i]
+		if !trustedIP(ip) {
+			break
+		}
+	}
+	return client
+}
+
+//forwardedFor returns the addresses of X-Forwarded-For, or of the RFC 7239 Forwarded header if there is none
+func forwardedFor(header http.Header) []string {
+	var chain []string
+	for _, val := range header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(val, ",") {
+			chain = append(chain, stripPort(strings.TrimSpace(addr)))
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, val := range header.Values("Forwarded") {
+		for _, element := range strings.Split(val, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					chain = append(chain, stripPort(strings.Trim(kv[1], `"`)))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+//SetHeaders prepares the forwarding headers for the backends. Headers coming from untrusted
+//peers are dropped, so clients can't spoof their address. Reverse proxy appends the peer's IP
+//to X-Forwarded-For on its own. With transparent proxy off, the other headers aren't added.
+func SetHeaders(r *http.Request, transparent bool) {
+	peer := helpers.ReturnIPFromHost(r.RemoteAddr)
+	if !trustedIP(net.ParseIP(peer)) {
+		for _, header := range forwardingHeaders {
+			r.Header.Del(header)
+		}
+	}
+
+	if !transparent {
+		return
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	node := peer
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	element := fmt.Sprintf(`for=%s;host="%s";proto=%s`, node, r.Host, proto)
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	r.Header.Set("Forwarded", element)
+}
@@ -0,0 +1,253 @@
+package forwardutil
+
+import (
+	"balansir/internal/helpers"
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func setTrusted(t *testing.T, cidrs ...string) {
+	nets, err := helpers.ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTrustedProxies(nets)
+	t.Cleanup(func() {
+		SetTrustedProxies(nil)
+	})
+}
+
+func newRequest(remoteAddr string, header map[string][]string) *http.Request {
+	r := &http.Request{RemoteAddr: remoteAddr, Host: "example.com", Header: http.Header{}}
+	for key, values := range header {
+		for _, val := range values {
+			r.Header.Add(key, val)
+		}
+	}
+	return r
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		header map[string][]string
+		want   string
+	}{
+		{
+			name:   "untrusted peer with forged X-Forwarded-For",
+			remote: "203.0.113.7:5000",
+			header: map[string][]string{"X-Forwarded-For": {"1.1.1.1"}},
+			want:   "203.0.113.7",
+		},
+		{
+			name:   "untrusted peer with forged Forwarded",
+			remote: "203.0.113.7:5000",
+			header: map[string][]string{"Forwarded": {"for=1.1.1.1"}},
+			want:   "203.0.113.7",
+		},
+		{
+			name:   "trusted peer without headers",
+			remote: "10.0.0.1:5000",
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "trusted peer",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "chain of trusted proxies",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 10.0.0.3", "10.0.0.2"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "client spoofs the chain's head",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "all of the chain is trusted",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:   "10.0.0.3",
+		},
+		{
+			name:   "garbage before the client",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"not-an-ip, 198.51.100.1, 10.0.0.2"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "garbage after trusted proxy",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1, <script>, 10.0.0.2"}},
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "garbage only",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"unknown"}},
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "empty entries",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1,,"}},
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "addresses with ports",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1:4000, [2001:db8::1]:443"}},
+			want:   "2001:db8::1",
+		},
+		{
+			name:   "ipv6 peer and chain",
+			remote: "[fd00::1]:5000",
+			header: map[string][]string{"X-Forwarded-For": {"2001:db8::1, fd00::2"}},
+			want:   "2001:db8::1",
+		},
+		{
+			name:   "Forwarded fallback",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"Forwarded": {`for=198.51.100.1;proto=https, for="10.0.0.2:8080"`}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "Forwarded fallback with ipv6",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"Forwarded": {`for="[2001:db8::1]:4711";host=example.com`}},
+			want:   "2001:db8::1",
+		},
+		{
+			name:   "Forwarded with obfuscated node",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"Forwarded": {`for=_hidden, for=10.0.0.2`}},
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "X-Forwarded-For wins over Forwarded",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=198.51.100.2"}},
+			want:   "198.51.100.1",
+		},
+	}
+
+	setTrusted(t, "10.0.0.0/8", "fd00::/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClientIP(newRequest(tt.remote, tt.header)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		remote      string
+		header      map[string][]string
+		transparent bool
+		tls         bool
+		want        map[string][]string
+	}{
+		{
+			name:        "untrusted peer headers are dropped",
+			remote:      "203.0.113.7:5000",
+			header:      map[string][]string{"X-Forwarded-For": {"1.1.1.1"}, "X-Forwarded-Host": {"evil.com"}, "X-Forwarded-Proto": {"https"}, "Forwarded": {"for=1.1.1.1"}},
+			transparent: true,
+			want: map[string][]string{
+				"X-Forwarded-For":   nil,
+				"X-Forwarded-Host":  {"example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {`for=203.0.113.7;host="example.com";proto=http`},
+			},
+		},
+		{
+			name:        "trusted peer headers are kept",
+			remote:      "10.0.0.1:5000",
+			header:      map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Host": {"example.org"}, "X-Forwarded-Proto": {"https"}, "Forwarded": {"for=198.51.100.1"}},
+			transparent: true,
+			want: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Host":  {"example.org"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for=198.51.100.1, for=10.0.0.1;host="example.com";proto=http`},
+			},
+		},
+		{
+			name:        "ipv6 peer over tls",
+			remote:      "[2001:db8::1]:5000",
+			transparent: true,
+			tls:         true,
+			want: map[string][]string{
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for="[2001:db8::1]";host="example.com";proto=https`},
+			},
+		},
+		{
+			name:   "transparent proxy off keeps trusted peer headers",
+			remote: "10.0.0.1:5000",
+			header: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "Forwarded": {"for=198.51.100.1"}},
+			want: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Host":  nil,
+				"X-Forwarded-Proto": nil,
+				"Forwarded":         {"for=198.51.100.1"},
+			},
+		},
+		{
+			name:   "transparent proxy off drops untrusted peer headers",
+			remote: "203.0.113.7:5000",
+			header: map[string][]string{"X-Forwarded-For": {"1.1.1.1"}, "X-Forwarded-Host": {"evil.com"}, "Forwarded": {"for=1.1.1.1"}},
+			want: map[string][]string{
+				"X-Forwarded-For":   nil,
+				"X-Forwarded-Host":  nil,
+				"X-Forwarded-Proto": nil,
+				"Forwarded":         nil,
+			},
+		},
+	}
+
+	setTrusted(t, "10.0.0.0/8")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRequest(tt.remote, tt.header)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			SetHeaders(r, tt.transparent)
+
+			for key, want := range tt.want {
+				got := r.Header.Values(key)
+				if len(got) != len(want) {
+					t.Errorf("got %v %q, want %q", key, got, want)
+					continue
+				}
+				for i := range want {
+					if got[i] != want[i] {
+						t.Errorf("got %v %q, want %q", key, got, want)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+//Reverse proxy appends the peer to X-Forwarded-For unless the header is set to nil
+func TestSetHeadersKeepsXForwardedForAppend(t *testing.T) {
+	for _, transparent := range []bool{true, false} {
+		r := newRequest("203.0.113.7:5000", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}})
+		SetHeaders(r, transparent)
+		if values, ok := r.Header["X-Forwarded-For"]; ok {
+			t.Errorf("transparent proxy %v: got X-Forwarded-For %q, want it left for the reverse proxy", transparent, values)
+		}
+	}
+}
@@ -3,9 +3,12 @@ package helpers
 import (
 	"balansir/internal/configutil"
 	"balansir/internal/logutil"
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -35,6 +38,29 @@ func ReturnIPFromHost(host string) string {
 	return ip
 }
 
+//ParseCIDRs parses the list of networks. Bare IP stands for a single host.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
 //RedirectTLS ...
 func RedirectTLS(w http.ResponseWriter, r *http.Request) {
 	ip := ReturnIPFromHost(r.Host)
@@ -44,10 +70,42 @@ func RedirectTLS(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
 }
 
-//AddRemoteAddrToRequest ...
-func AddRemoteAddrToRequest(r *http.Request) *http.Request {
-	r.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	return r
+//BufferRequestBody reads up to limit bytes of the request body into memory, so the request can be replayed.
+//If the body is bigger than limit, it's left streamable and false is returned.
+func BufferRequestBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		r.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	ResetRequestBody(r, body)
+	return body, true, nil
+}
+
+//ResetRequestBody ...
+func ResetRequestBody(r *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
 //SetSession ...
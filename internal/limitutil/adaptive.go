@@ -0,0 +1,209 @@
+package limitutil
+
+import (
+	"balansir/internal/configutil"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInitialLimit = 20
+	defaultMinLimit     = 5
+	defaultMaxLimit     = 1000
+	defaultLimitWindow  = 500
+	defaultTolerance    = 1.5
+
+	//Share of the new limit estimation applied every window
+	limitSmoothing = 0.2
+	//Limit backoff on transport errors
+	limitBackoff = 0.9
+	//Min RTT is measured anew from time to time, so it follows the changes on the backends
+	minRTTLifetime = 30 * time.Second
+)
+
+//AdaptiveSettings ...
+type AdaptiveSettings struct {
+	Enabled      bool
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	Window       time.Duration
+	Tolerance    float64
+}
+
+//GetAdaptiveSettings ...
+func GetAdaptiveSettings(adaptiveConcurrency *configutil.AdaptiveConcurrency) AdaptiveSettings {
+	settings := AdaptiveSettings{
+		Enabled:      adaptiveConcurrency.Enabled,
+		InitialLimit: adaptiveConcurrency.InitialLimit,
+		MinLimit:     adaptiveConcurrency.MinLimit,
+		MaxLimit:     adaptiveConcurrency.MaxLimit,
+		Window:       time.Duration(adaptiveConcurrency.Window) * time.Millisecond,
+		Tolerance:    adaptiveConcurrency.Tolerance,
+	}
+
+	if settings.MinLimit <= 0 {
+		settings.MinLimit = defaultMinLimit
+	}
+	if settings.MaxLimit <= 0 {
+		settings.MaxLimit = defaultMaxLimit
+	}
+	if settings.MaxLimit < settings.MinLimit {
+		settings.MaxLimit = settings.MinLimit
+	}
+	if settings.InitialLimit <= 0 {
+		settings.InitialLimit = defaultInitialLimit
+	}
+	if settings.Window <= 0 {
+		settings.Window = defaultLimitWindow * time.Millisecond
+	}
+	if settings.Tolerance < 1 {
+		settings.Tolerance = defaultTolerance
+	}
+
+	return settings
+}
+
+//AdaptiveLimiter limits the number of in-flight requests. The limit follows the gradient
+//between the minimal and the current response time: it grows while latency stays close
+//to the minimum and shrinks as soon as the backends start queueing requests up.
+type AdaptiveLimiter struct {
+	mux         sync.Mutex
+	limit       float64
+	inFlight    int
+	maxInFlight int
+	minRTT      time.Duration
+	nextMinRTT  time.Duration
+	minRTTSince time.Time
+	rtt         time.Duration
+	windowStart time.Time
+	rttSum      time.Duration
+	samples     int
+	drops       int
+	shed        int64
+}
+
+//Acquire takes an in-flight slot, unless the limit is reached
+func (l *AdaptiveLimiter) Acquire(settings AdaptiveSettings) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.init(settings)
+	if l.inFlight >= int(l.limit) {
+		l.shed++
+		return false
+	}
+
+	l.inFlight++
+	if l.inFlight > l.maxInFlight {
+		l.maxInFlight = l.inFlight
+	}
+	return true
+}
+
+//Release ...
+func (l *AdaptiveLimiter) Release() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.inFlight > 0 {
+		l.inFlight--
+	}
+}
+
+//Sample records the response time
+func (l *AdaptiveLimiter) Sample(rtt time.Duration, settings AdaptiveSettings) {
+	if rtt <= 0 {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.init(settings)
+	if l.minRTT == 0 || rtt < l.minRTT {
+		l.minRTT = rtt
+	}
+	if l.nextMinRTT == 0 || rtt < l.nextMinRTT {
+		l.nextMinRTT = rtt
+	}
+	l.rttSum += rtt
+	l.samples++
+	l.update(settings)
+}
+
+//Drop records a failed request
+func (l *AdaptiveLimiter) Drop(settings AdaptiveSettings) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.init(settings)
+	l.drops++
+	l.update(settings)
+}
+
+func (l *AdaptiveLimiter) init(settings AdaptiveSettings) {
+	if l.limit == 0 {
+		l.limit = float64(settings.InitialLimit)
+		l.windowStart = time.Now()
+		l.minRTTSince = time.Now()
+	}
+}
+
+func (l *AdaptiveLimiter) update(settings AdaptiveSettings) {
+	if time.Since(l.windowStart) < settings.Window {
+		return
+	}
+
+	newLimit := l.limit
+	switch {
+	case l.drops > 0:
+		newLimit = l.limit * limitBackoff
+	case l.samples > 0:
+		l.rtt = l.rttSum / time.Duration(l.samples)
+		gradient := math.Max(0.5, math.Min(1, settings.Tolerance*float64(l.minRTT)/float64(l.rtt)))
+		newLimit = l.limit*gradient + math.Sqrt(l.limit)
+
+		//Limit only grows while it's actually in use
+		if newLimit > l.limit && l.maxInFlight*2 < int(l.limit) {
+			newLimit = l.limit
+		}
+	}
+
+	l.limit = l.limit*(1-limitSmoothing) + newLimit*limitSmoothing
+	l.limit = math.Max(float64(settings.MinLimit), math.Min(float64(settings.MaxLimit), l.limit))
+
+	if time.Since(l.minRTTSince) >= minRTTLifetime && l.nextMinRTT > 0 {
+		l.minRTT = l.nextMinRTT
+		l.nextMinRTT = 0
+		l.minRTTSince = time.Now()
+	}
+
+	l.windowStart = time.Now()
+	l.rttSum = 0
+	l.samples = 0
+	l.drops = 0
+	l.maxInFlight = l.inFlight
+}
+
+//AdaptiveStats ...
+type AdaptiveStats struct {
+	Limit    int
+	InFlight int
+	MinRTT   time.Duration
+	RTT      time.Duration
+	Shed     int64
+}
+
+//GetStats ...
+func (l *AdaptiveLimiter) GetStats() AdaptiveStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return AdaptiveStats{
+		Limit:    int(l.limit),
+		InFlight: l.inFlight,
+		MinRTT:   l.minRTT,
+		RTT:      l.rtt,
+		Shed:     l.shed,
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"balansir/internal/helpers"
 	"balansir/internal/logutil"
 	"balansir/internal/metricsutil"
+	"balansir/internal/proxyprotoutil"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -62,7 +64,7 @@ func ServeTLSWithAutocert() {
 			WriteTimeout: time.Duration(configuration.WriteTimeout) * time.Second,
 		}
 
-		logutil.Fatal(server.ListenAndServe())
+		logutil.Fatal(serve(server))
 
 		<-done
 		gracefulShutdown(server)
@@ -81,7 +83,7 @@ func ServeTLSWithAutocert() {
 	}
 
 	go func() {
-		logutil.Fatal(TLSServer.ListenAndServeTLS("", ""))
+		logutil.Fatal(serveTLS(TLSServer, "", ""))
 	}()
 	logutil.Notice("Balansir is up!")
 
@@ -104,7 +106,7 @@ func ServeTLSWithSelfSignedCerts() {
 			WriteTimeout: time.Duration(configuration.WriteTimeout) * time.Second,
 		}
 
-		logutil.Fatal(server.ListenAndServe())
+		logutil.Fatal(serve(server))
 
 		<-done
 		gracefulShutdown(server)
@@ -120,7 +122,7 @@ func ServeTLSWithSelfSignedCerts() {
 	}
 
 	go func() {
-		logutil.Fatal(TLSServer.ListenAndServeTLS(configuration.SSLCertificate, configuration.SSLKey))
+		logutil.Fatal(serveTLS(TLSServer, configuration.SSLCertificate, configuration.SSLKey))
 	}()
 	logutil.Notice("Balansir is up!")
 
@@ -143,7 +145,7 @@ func Serve() {
 	}
 
 	go func() {
-		logutil.Fatal(server.ListenAndServe())
+		logutil.Fatal(serve(server))
 	}()
 	logutil.Notice("Balansir is up!")
 
@@ -151,6 +153,24 @@ func Serve() {
 	gracefulShutdown(server)
 }
 
+//Connections are accepted through the PROXY protocol listener, so the header from
+//the trusted sources is read ahead of the HTTP traffic
+func serve(server *http.Server) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(proxyprotoutil.NewListener(listener, server.ReadTimeout))
+}
+
+func serveTLS(server *http.Server, certFile string, keyFile string) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	return server.ServeTLS(proxyprotoutil.NewListener(listener, server.ReadTimeout), certFile, keyFile)
+}
+
 func gracefulShutdown(server *http.Server) {
 	logutil.Notice("Shutting down Balansir...")
 
@@ -0,0 +1,90 @@
+package listenutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/logutil"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	//TCPProtocol ...
+	TCPProtocol = "tcp"
+	//UDPProtocol ...
+	UDPProtocol = "udp"
+)
+
+//layer 4 listener bound to one of the configured ports
+type l4Listener interface {
+	getConfig() *configutil.Listener
+	setConfig(config *configutil.Listener)
+	close()
+}
+
+var listeners = make(map[string]l4Listener)
+var listenersMux sync.Mutex
+
+//SyncListeners binds newly configured listeners and closes the removed ones.
+//Listener that keeps its port and protocol only gets the fresh settings, so its connections survive the reload.
+func SyncListeners(configs []*configutil.Listener) []error {
+	listenersMux.Lock()
+	defer listenersMux.Unlock()
+
+	var errs []error
+	configured := make(map[string]bool)
+	for _, config := range configs {
+		configured[config.Name] = true
+
+		if l, ok := listeners[config.Name]; ok {
+			if old := l.getConfig(); old.Port == config.Port && old.Protocol == config.Protocol {
+				l.setConfig(config)
+				continue
+			}
+			l.close()
+			delete(listeners, config.Name)
+		}
+
+		var l l4Listener
+		var err error
+		switch config.Protocol {
+		case TCPProtocol:
+			l, err = newTCPListener(config)
+		case UDPProtocol:
+			l, err = newUDPListener(config)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`can't bind (%s) listener in config["listeners"]: %w`, config.Name, err))
+			continue
+		}
+
+		listeners[config.Name] = l
+		logutil.Notice(fmt.Sprintf("Listening %s on :%v for (%s) upstream", strings.ToUpper(config.Protocol), config.Port, config.Upstream))
+	}
+
+	for name, l := range listeners {
+		if !configured[name] {
+			l.close()
+			delete(listeners, name)
+		}
+	}
+
+	return errs
+}
+
+type listenerConfig struct {
+	mux    sync.RWMutex
+	config *configutil.Listener
+}
+
+func (lc *listenerConfig) getConfig() *configutil.Listener {
+	lc.mux.RLock()
+	defer lc.mux.RUnlock()
+	return lc.config
+}
+
+func (lc *listenerConfig) setConfig(config *configutil.Listener) {
+	lc.mux.Lock()
+	defer lc.mux.Unlock()
+	lc.config = config
+}
@@ -0,0 +1,128 @@
+package listenutil
+
+import (
+	"balansir/internal/balanceutil"
+	"balansir/internal/configutil"
+	"balansir/internal/logutil"
+	"balansir/internal/poolutil"
+	"balansir/internal/proxyprotoutil"
+	"balansir/internal/serverutil"
+	"balansir/internal/tunnelutil"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//tcpListener pipes accepted connections to the servers of the upstream pool
+type tcpListener struct {
+	listenerConfig
+	listener net.Listener
+}
+
+func newTCPListener(config *configutil.Listener) (*tcpListener, error) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &tcpListener{listener: listener}
+	l.setConfig(config)
+	go l.serve()
+	return l, nil
+}
+
+func (l *tcpListener) close() {
+	l.listener.Close()
+}
+
+func (l *tcpListener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logutil.Warning(fmt.Sprintf("Error accepting TCP connection: %v", err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *tcpListener) handle(client net.Conn) {
+	config := l.getConfig()
+
+	pool := poolutil.GetPoolByName(config.Upstream)
+	if pool == nil {
+		client.Close()
+		return
+	}
+
+	settings := tunnelutil.GetSettings(&pool.GetUpstream().Tunnel)
+	if config.IdleTimeout > 0 {
+		settings.IdleTimeout = time.Duration(config.IdleTimeout) * time.Second
+	}
+
+	endpoint, backend := dialServer(pool, client)
+	if backend == nil {
+		logutil.Warning(fmt.Sprintf("No available servers for (%s) listener", config.Name))
+		client.Close()
+		return
+	}
+
+	endpoint.IncreaseActiveConnections()
+	tunnelutil.Pipe(client, backend, settings, tunnelutil.GetCounters(config.Name))
+	endpoint.DecreaseActiveConnections()
+	pool.Release(endpoint)
+}
+
+//Connections and flows are balanced as requests carrying the client's address only, so hashing keys on the IP
+func clientRequest(client net.Addr) *http.Request {
+	return &http.Request{RemoteAddr: client.String(), Header: http.Header{}, URL: &url.URL{}}
+}
+
+//dialServer connects to a server chosen with the pool's algorithm, trying the other ones on failure
+func dialServer(pool *poolutil.ServerPool, client net.Conn) (*serverutil.Server, net.Conn) {
+	r := clientRequest(client.RemoteAddr())
+	timeout := time.Duration(pool.GetUpstream().WriteTimeout) * time.Second
+
+	var tried []*serverutil.Server
+	for {
+		endpoint := balanceutil.SelectServer(pool, r, tried)
+		if endpoint == nil {
+			return nil, nil
+		}
+		tried = append(tried, endpoint)
+
+		if !endpoint.TryAcquire() {
+			continue
+		}
+		if !endpoint.Breaker.Allow() {
+			pool.Release(endpoint)
+			continue
+		}
+
+		start := time.Now()
+		backend, err := net.DialTimeout("tcp", endpoint.URL.Host, timeout)
+		if err != nil {
+			logutil.Warning(fmt.Sprintf("Error connecting to %s: %v", endpoint.URL.Host, err))
+			pool.ReportError(endpoint, err)
+			pool.Release(endpoint)
+			continue
+		}
+		if err := proxyprotoutil.WriteHeader(backend, pool.GetUpstream().SendProxyProtocol, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			logutil.Warning(fmt.Sprintf("Error sending PROXY protocol header to %s: %v", endpoint.URL.Host, err))
+			backend.Close()
+			pool.ReportError(endpoint, err)
+			pool.Release(endpoint)
+			continue
+		}
+		pool.ReportConnect(endpoint, time.Since(start))
+		return endpoint, backend
+	}
+}
@@ -0,0 +1,406 @@
+package listenutil
+
+import (
+	"balansir/internal/balanceutil"
+	"balansir/internal/configutil"
+	"balansir/internal/logutil"
+	"balansir/internal/poolutil"
+	"balansir/internal/serverutil"
+	"balansir/internal/tunnelutil"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//UDPFlowMode ...
+	UDPFlowMode = "flow"
+	//UDPHashMode ...
+	UDPHashMode = "hash"
+
+	defaultUDPIdleTimeout = 30
+	maxDatagramSize       = 64 * 1024
+	//Hash mode datagrams are handled by a fixed number of workers,
+	//the ones that don't fit into the queue are dropped
+	udpHashWorkers   = 64
+	udpHashQueueSize = 1024
+)
+
+//udpListener forwards datagrams to the servers of the upstream pool. In flow mode every client
+//gets its own socket to the chosen server, so the replies find their way back. Flows expire
+//after the idle timeout. In hash mode no state is kept between datagrams, every one of them
+//is balanced on its own, so a consistent hash pool keeps the client on the same server.
+//Datagrams are sent through a socket shared by all the clients of the server, unless
+//the listener waits for replies. Then each datagram waits for a single reply on its own socket.
+//Replies on the shared socket are dropped, it's only read to detect the refusing servers.
+type udpListener struct {
+	listenerConfig
+	conn        net.PacketConn
+	flows       map[string]*flow
+	flowsMux    sync.Mutex
+	datagrams   chan *datagram
+	workersOnce sync.Once
+	backends    map[string]net.Conn
+	backendsMux sync.Mutex
+	done        chan struct{}
+}
+
+type datagram struct {
+	config  *configutil.Listener
+	pool    *poolutil.ServerPool
+	client  net.Addr
+	payload []byte
+}
+
+type flow struct {
+	client     net.Addr
+	pool       *poolutil.ServerPool
+	endpoint   *serverutil.Server
+	backend    net.Conn
+	counters   *tunnelutil.Counters
+	total      *tunnelutil.Counters
+	lastActive int64
+}
+
+func newUDPListener(config *configutil.Listener) (*udpListener, error) {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(config.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{
+		conn:      conn,
+		flows:     make(map[string]*flow),
+		datagrams: make(chan *datagram, udpHashQueueSize),
+		backends:  make(map[string]net.Conn),
+		done:      make(chan struct{}),
+	}
+	l.setConfig(config)
+	go l.serve()
+	go l.expire()
+	return l, nil
+}
+
+func (l *udpListener) close() {
+	close(l.done)
+	l.conn.Close()
+
+	l.flowsMux.Lock()
+	for key, f := range l.flows {
+		l.closeFlow(key, f)
+	}
+	l.flowsMux.Unlock()
+
+	l.backendsMux.Lock()
+	defer l.backendsMux.Unlock()
+	for host, backend := range l.backends {
+		backend.Close()
+		delete(l.backends, host)
+	}
+}
+
+func idleTimeout(config *configutil.Listener) time.Duration {
+	if config.IdleTimeout <= 0 {
+		return defaultUDPIdleTimeout * time.Second
+	}
+	return time.Duration(config.IdleTimeout) * time.Second
+}
+
+func (l *udpListener) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logutil.Warning(fmt.Sprintf("Error reading UDP datagram: %v", err))
+			continue
+		}
+
+		config := l.getConfig()
+		tunnelutil.GetCounters(config.Name).CountIn(n)
+
+		pool := poolutil.GetPoolByName(config.Upstream)
+		if pool == nil {
+			continue
+		}
+
+		if config.Mode == UDPHashMode {
+			l.workersOnce.Do(l.startWorkers)
+			select {
+			case l.datagrams <- &datagram{config: config, pool: pool, client: client, payload: append([]byte(nil), buf[:n]...)}:
+			default:
+				tunnelutil.GetCounters(config.Name).CountDropped()
+			}
+			continue
+		}
+		l.forward(config, pool, client, buf[:n])
+	}
+}
+
+func (l *udpListener) forward(config *configutil.Listener, pool *poolutil.ServerPool, client net.Addr, datagram []byte) {
+	f := l.getFlow(config, pool, client)
+	if f == nil {
+		return
+	}
+
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+	if _, err := f.backend.Write(datagram); err != nil {
+		logutil.Warning(fmt.Sprintf("Error sending UDP datagram to %s: %v", f.endpoint.URL.Host, err))
+		return
+	}
+	f.counters.CountIn(len(datagram))
+}
+
+//getFlow returns the client's flow, opening a new one to the server chosen with the pool's algorithm
+func (l *udpListener) getFlow(config *configutil.Listener, pool *poolutil.ServerPool, client net.Addr) *flow {
+	key := client.String()
+
+	l.flowsMux.Lock()
+	defer l.flowsMux.Unlock()
+	if f, ok := l.flows[key]; ok {
+		return f
+	}
+
+	r := clientRequest(client)
+	var tried []*serverutil.Server
+	for {
+		endpoint := balanceutil.SelectServer(pool, r, tried)
+		if endpoint == nil {
+			logutil.Warning(fmt.Sprintf("No available servers for (%s) listener", config.Name))
+			return nil
+		}
+		tried = append(tried, endpoint)
+
+		if !endpoint.TryAcquire() {
+			continue
+		}
+		backend, err := net.Dial("udp", endpoint.URL.Host)
+		if err != nil {
+			logutil.Warning(fmt.Sprintf("Error connecting to %s: %v", endpoint.URL.Host, err))
+			pool.ReportError(endpoint, err)
+			pool.Release(endpoint)
+			continue
+		}
+
+		f := &flow{
+			client:     client,
+			pool:       pool,
+			endpoint:   endpoint,
+			backend:    backend,
+			counters:   tunnelutil.GetBackendCounters(config.Name, endpoint.URL.Host),
+			total:      tunnelutil.GetCounters(config.Name),
+			lastActive: time.Now().UnixNano(),
+		}
+		endpoint.IncreaseActiveConnections()
+		f.counters.Open()
+		f.total.Open()
+		l.flows[key] = f
+
+		go l.reply(key, f)
+		return f
+	}
+}
+
+//reply sends the server's datagrams back to the flow's client
+func (l *udpListener) reply(key string, f *flow) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := f.backend.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			//Server refuses the datagrams, the client gets another one with the next datagram
+			f.pool.ReportError(f.endpoint, err)
+			l.flowsMux.Lock()
+			if l.flows[key] == f {
+				l.closeFlow(key, f)
+			}
+			l.flowsMux.Unlock()
+			return
+		}
+
+		atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+		if _, err := l.conn.WriteTo(buf[:n], f.client); err != nil {
+			continue
+		}
+		f.counters.CountOut(n)
+		f.total.CountOut(n)
+	}
+}
+
+func (l *udpListener) expire() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			timeout := idleTimeout(l.getConfig())
+			l.flowsMux.Lock()
+			for key, f := range l.flows {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&f.lastActive))) >= timeout {
+					l.closeFlow(key, f)
+				}
+			}
+			l.flowsMux.Unlock()
+		}
+	}
+}
+
+//closeFlow must be called with the flows lock held
+func (l *udpListener) closeFlow(key string, f *flow) {
+	delete(l.flows, key)
+	f.backend.Close()
+	f.endpoint.DecreaseActiveConnections()
+	f.counters.Close()
+	f.total.Close()
+	f.pool.Release(f.endpoint)
+}
+
+func (l *udpListener) startWorkers() {
+	for i := 0; i < udpHashWorkers; i++ {
+		go l.work()
+	}
+}
+
+func (l *udpListener) work() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		select {
+		case <-l.done:
+			return
+		case d := <-l.datagrams:
+			l.forwardOnce(d, buf)
+		}
+	}
+}
+
+//forwardOnce sends the datagram to the server chosen with the pool's algorithm
+//and passes the single reply back, if the listener waits for one
+func (l *udpListener) forwardOnce(d *datagram, buf []byte) {
+	r := clientRequest(d.client)
+	var tried []*serverutil.Server
+	for {
+		endpoint := balanceutil.SelectServer(d.pool, r, tried)
+		if endpoint == nil {
+			logutil.Warning(fmt.Sprintf("No available servers for (%s) listener", d.config.Name))
+			tunnelutil.GetCounters(d.config.Name).CountDropped()
+			return
+		}
+		tried = append(tried, endpoint)
+
+		if !endpoint.TryAcquire() {
+			continue
+		}
+		err := l.send(d, endpoint, buf)
+		d.pool.Release(endpoint)
+		if err == nil {
+			return
+		}
+		d.pool.ReportError(endpoint, err)
+	}
+}
+
+func (l *udpListener) send(d *datagram, endpoint *serverutil.Server, buf []byte) error {
+	endpoint.IncreaseActiveConnections()
+	defer endpoint.DecreaseActiveConnections()
+
+	counters := tunnelutil.GetBackendCounters(d.config.Name, endpoint.URL.Host)
+	counters.Open()
+	defer counters.Close()
+
+	if !d.config.WaitReply {
+		backend, err := l.getBackend(d.pool, endpoint)
+		if err != nil {
+			return err
+		}
+		if _, err := backend.Write(d.payload); err != nil {
+			return err
+		}
+		counters.CountIn(len(d.payload))
+		return nil
+	}
+
+	//Reply can only be told apart from the other clients' ones on a socket of its own
+	backend, err := net.Dial("udp", endpoint.URL.Host)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	start := time.Now()
+	if _, err := backend.Write(d.payload); err != nil {
+		return err
+	}
+	counters.CountIn(len(d.payload))
+
+	backend.SetReadDeadline(time.Now().Add(idleTimeout(d.config))) //nolint
+	n, err := backend.Read(buf)
+	if err != nil {
+		//Lost datagrams are nothing unusual for UDP, only refused ones are the server's fault
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+	d.pool.ReportLatency(endpoint, time.Since(start))
+
+	if _, err := l.conn.WriteTo(buf[:n], d.client); err == nil {
+		counters.CountOut(n)
+		tunnelutil.GetCounters(d.config.Name).CountOut(n)
+	}
+	return nil
+}
+
+//getBackend returns the socket shared by the datagrams sent to the server
+func (l *udpListener) getBackend(pool *poolutil.ServerPool, endpoint *serverutil.Server) (net.Conn, error) {
+	host := endpoint.URL.Host
+
+	l.backendsMux.Lock()
+	defer l.backendsMux.Unlock()
+
+	if backend, ok := l.backends[host]; ok {
+		return backend, nil
+	}
+	backend, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	l.backends[host] = backend
+
+	go l.drain(host, backend, pool, endpoint)
+	return backend, nil
+}
+
+//drain reads the shared socket for the server's errors. Replies on it can't be told apart
+//between the clients, so they're dropped. Once the server refuses the datagrams, the socket
+//is closed and the next datagram dials the server again.
+func (l *udpListener) drain(host string, backend net.Conn, pool *poolutil.ServerPool, endpoint *serverutil.Server) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		if _, err := backend.Read(buf); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			pool.ReportError(endpoint, err)
+
+			l.backendsMux.Lock()
+			if l.backends[host] == backend {
+				delete(l.backends, host)
+			}
+			l.backendsMux.Unlock()
+			backend.Close()
+			return
+		}
+	}
+}
@@ -7,12 +7,15 @@ import (
 	"balansir/internal/metricsutil/pstats"
 	"balansir/internal/poolutil"
 	"balansir/internal/rateutil"
+	"balansir/internal/routeutil"
 	"balansir/internal/serverutil"
 	"balansir/internal/statusutil"
+	"balansir/internal/tunnelutil"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"runtime"
@@ -33,27 +36,129 @@ type objects struct {
 
 //Stats ...
 type Stats struct {
-	Timestamp           int64         `json:"timestamp"`
-	RequestsPerSecond   float64       `json:"requests_per_second"`
+	Timestamp           int64            `json:"timestamp"`
+	RequestsPerSecond   float64          `json:"requests_per_second"`
+	AverageResponseTime float64          `json:"average_response_time"`
+	MemoryUsage         int64            `json:"memory_usage"`
+	ErrorsCount         int64            `json:"errors_count"`
+	Port                int              `json:"http_port"`
+	TLSPort             int              `json:"https_port"`
+	Endpoints           []*endpoint      `json:"endpoints"`
+	TransparentProxy    bool             `json:"transparent_proxy"`
+	Algorithm           string           `json:"balancing_algorithm"`
+	Cache               bool             `json:"cache"`
+	CacheInfo           cacheInfo        `json:"cache_info"`
+	StatusCodes         map[int]int64    `json:"status_codes"`
+	Pools               []*poolStats     `json:"pools"`
+	Splits              []*splitStats    `json:"splits"`
+	Mirrors             []*mirrorStats   `json:"mirrors"`
+	OpenTunnels         int64            `json:"open_tunnels"`
+	Listeners           []*listenerStats `json:"listeners"`
+}
+
+type listenerStats struct {
+	Name              string          `json:"name"`
+	Protocol          string          `json:"protocol"`
+	Port              int             `json:"port"`
+	Upstream          string          `json:"upstream"`
+	ActiveConnections int64           `json:"active_connections"`
+	TotalConnections  int64           `json:"total_connections"`
+	BytesIn           int64           `json:"bytes_in"`
+	BytesOut          int64           `json:"bytes_out"`
+	PacketsIn         int64           `json:"packets_in"`
+	PacketsOut        int64           `json:"packets_out"`
+	Dropped           int64           `json:"dropped"`
+	Backends          []*backendStats `json:"backends,omitempty"`
+}
+
+type backendStats struct {
+	Endpoint    string `json:"endpoint"`
+	ActiveFlows int64  `json:"active_flows"`
+	TotalFlows  int64  `json:"total_flows"`
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	PacketsIn   int64  `json:"packets_in"`
+	PacketsOut  int64  `json:"packets_out"`
+}
+
+type mirrorStats struct {
+	Route    string        `json:"route"`
+	Upstream string        `json:"upstream"`
+	Percent  float64       `json:"percent"`
+	Dropped  int64         `json:"dropped"`
+	Primary  *trafficStats `json:"primary"`
+	Shadow   *trafficStats `json:"shadow"`
+}
+
+type trafficStats struct {
+	Requests            int64         `json:"requests"`
 	AverageResponseTime float64       `json:"average_response_time"`
-	MemoryUsage         int64         `json:"memory_usage"`
-	ErrorsCount         int64         `json:"errors_count"`
-	Port                int           `json:"http_port"`
-	TLSPort             int           `json:"https_port"`
-	Endpoints           []*endpoint   `json:"endpoints"`
-	TransparentProxy    bool          `json:"transparent_proxy"`
-	Algorithm           string        `json:"balancing_algorithm"`
-	Cache               bool          `json:"cache"`
-	CacheInfo           cacheInfo     `json:"cache_info"`
 	StatusCodes         map[int]int64 `json:"status_codes"`
 }
 
+type splitStats struct {
+	Route    string          `json:"route"`
+	Variants []*variantStats `json:"variants"`
+}
+
+type variantStats struct {
+	Upstream            string        `json:"upstream"`
+	Weight              int           `json:"weight"`
+	Requests            int64         `json:"requests"`
+	AverageResponseTime float64       `json:"average_response_time"`
+	StatusCodes         map[int]int64 `json:"status_codes"`
+}
+
+type poolStats struct {
+	Name        string         `json:"name"`
+	Algorithm   string         `json:"balancing_algorithm"`
+	Endpoints   []*endpoint    `json:"endpoints"`
+	StatusCodes map[int]int64  `json:"status_codes"`
+	Queue       queueStats     `json:"queue"`
+	Adaptive    *adaptiveStats `json:"adaptive_concurrency,omitempty"`
+	Hedged      int64          `json:"hedged_requests"`
+}
+
+type adaptiveStats struct {
+	Limit    int     `json:"limit"`
+	InFlight int     `json:"in_flight"`
+	MinRTT   float64 `json:"min_rtt"`
+	RTT      float64 `json:"rtt"`
+	Shed     int64   `json:"shed"`
+}
+
+type queueStats struct {
+	Depth           int     `json:"depth"`
+	Size            int     `json:"size"`
+	AverageWaitTime float64 `json:"average_wait_time"`
+	Timeouts        int64   `json:"timeouts"`
+	Rejected        int64   `json:"rejected"`
+}
+
 type endpoint struct {
-	URL               string  `json:"url"`
-	Active            bool    `json:"active"`
-	Weight            float64 `json:"weight"`
-	ActiveConnections int64   `json:"active_connections"`
-	ServerHash        string  `json:"server_hash"`
+	URL               string     `json:"url"`
+	Active            bool       `json:"active"`
+	Weight            float64    `json:"weight"`
+	EffectiveWeight   float64    `json:"effective_weight"`
+	Priority          int        `json:"priority"`
+	ActiveConnections int64      `json:"active_connections"`
+	ActiveRequests    int64      `json:"active_requests"`
+	MaxConnections    int        `json:"max_connections"`
+	MaxRequests       int        `json:"max_requests"`
+	ServerHash        string     `json:"server_hash"`
+	LastCheck         *lastCheck `json:"last_check"`
+	Ejected           bool       `json:"ejected"`
+	Ejections         int64      `json:"ejections"`
+	CircuitBreaker    string     `json:"circuit_breaker"`
+	ResponseTimeEWMA  float64    `json:"response_time_ewma"`
+}
+
+type lastCheck struct {
+	Timestamp  int64   `json:"timestamp"`
+	Success    bool    `json:"success"`
+	StatusCode int     `json:"status_code,omitempty"`
+	Latency    float64 `json:"latency"`
+	Error      string  `json:"error,omitempty"`
 }
 
 type cacheInfo struct {
@@ -62,6 +167,7 @@ type cacheInfo struct {
 	ShardSize    int     `json:"shard_size_mb"`
 	Hits         int64   `json:"hits"`
 	Misses       int64   `json:"misses"`
+	Purges       int64   `json:"purges"`
 }
 
 //MetrictStats ...
@@ -124,17 +230,88 @@ func InitMetricsMeta(rc *rateutil.Rate, c *configutil.Configuration, s []*server
 
 func getBalansirStats() *Stats {
 	runtime.ReadMemStats(&mem)
-	endpoints := make([]*endpoint, len(metrics.servers))
-	for i, server := range metrics.servers {
-		server.Mux.RLock()
-		endpoints[i] = &endpoint{
-			server.URL.String(),
-			server.Alive,
-			server.Weight,
-			server.GetActiveConnections(),
-			server.ServerHash,
+	endpoints := getEndpoints(poolutil.GetPool())
+
+	pools := poolutil.GetPools()
+	poolsStats := make([]*poolStats, len(pools))
+	for i, pool := range pools {
+		var adaptive *adaptiveStats
+		if pool.GetUpstream().AdaptiveConcurrency.Enabled {
+			limiterStats := pool.Limiter.GetStats()
+			adaptive = &adaptiveStats{
+				Limit:    limiterStats.Limit,
+				InFlight: limiterStats.InFlight,
+				MinRTT:   math.Round(float64(limiterStats.MinRTT.Microseconds())/10) / 100,
+				RTT:      math.Round(float64(limiterStats.RTT.Microseconds())/10) / 100,
+				Shed:     limiterStats.Shed,
+			}
+		}
+
+		poolsStats[i] = &poolStats{
+			Name:        pool.Name,
+			Algorithm:   pool.GetUpstream().Algorithm,
+			Endpoints:   getEndpoints(pool),
+			StatusCodes: pool.StatusCodes.GetStatuses(),
+			Queue: queueStats{
+				Depth:           pool.Queue.GetDepth(),
+				Size:            pool.GetUpstream().Queue.Size,
+				AverageWaitTime: math.Round(float64(pool.Queue.GetAverageWaitTime().Microseconds())/10) / 100,
+				Timeouts:        pool.Queue.GetTimeouts(),
+				Rejected:        pool.Queue.GetRejected(),
+			},
+			Adaptive: adaptive,
+			Hedged:   pool.GetHedges(),
 		}
-		server.Mux.RUnlock()
+	}
+
+	listeners := make([]*listenerStats, len(metrics.configuration.Listeners))
+	for i, listener := range metrics.configuration.Listeners {
+		counters := tunnelutil.GetCounters(listener.Name)
+		listeners[i] = &listenerStats{
+			Name:              listener.Name,
+			Protocol:          listener.Protocol,
+			Port:              listener.Port,
+			Upstream:          listener.Upstream,
+			ActiveConnections: counters.GetActive(),
+			TotalConnections:  counters.GetTotal(),
+			BytesIn:           counters.GetBytesIn(),
+			BytesOut:          counters.GetBytesOut(),
+			PacketsIn:         counters.GetPacketsIn(),
+			PacketsOut:        counters.GetPacketsOut(),
+			Dropped:           counters.GetDropped(),
+			Backends:          getBackends(listener),
+		}
+	}
+
+	var splits []*splitStats
+	var mirrors []*mirrorStats
+	for _, route := range routeutil.GetTable().Routes() {
+		if route.Mirror != nil {
+			mirrors = append(mirrors, &mirrorStats{
+				Route:    route.Name,
+				Upstream: route.Mirror.Upstream,
+				Percent:  route.Mirror.Percent,
+				Dropped:  route.Mirror.Shadow.GetDropped(),
+				Primary:  getTrafficStats(route.Mirror.Primary),
+				Shadow:   getTrafficStats(route.Mirror.Shadow),
+			})
+		}
+
+		if route.Split == nil {
+			continue
+		}
+		split := &splitStats{Route: route.Name}
+		for _, variant := range route.Split.Variants() {
+			responseTime := variant.Stats.GetAverageResponseTime()
+			split.Variants = append(split.Variants, &variantStats{
+				Upstream:            variant.Upstream,
+				Weight:              variant.Weight,
+				Requests:            variant.Stats.GetRequests(),
+				AverageResponseTime: math.Round(float64(responseTime.Microseconds())/10) / 100,
+				StatusCodes:         variant.Stats.StatusCodes.GetStatuses(),
+			})
+		}
+		splits = append(splits, split)
 	}
 
 	stats := Stats{
@@ -150,6 +327,11 @@ func getBalansirStats() *Stats {
 		Algorithm:           metrics.configuration.Algorithm,
 		Cache:               metrics.configuration.Cache.Enabled,
 		StatusCodes:         metrics.statusCodes.GetStatuses(),
+		Pools:               poolsStats,
+		Splits:              splits,
+		Mirrors:             mirrors,
+		OpenTunnels:         tunnelutil.GetOpen(),
+		Listeners:           listeners,
 	}
 
 	cache := cacheutil.GetCluster()
@@ -160,12 +342,88 @@ func getBalansirStats() *Stats {
 			ShardSize:    metrics.cache.ShardSize,
 			Hits:         atomic.LoadInt64(&metrics.cache.Hits),
 			Misses:       atomic.LoadInt64(&metrics.cache.Misses),
+			Purges:       metrics.cache.GetPurges(),
 		}
 	}
 
 	return &stats
 }
 
+//Backends are only tracked for the UDP flows
+func getBackends(listener *configutil.Listener) []*backendStats {
+	pool := poolutil.GetPoolByName(listener.Upstream)
+	if listener.Protocol != "udp" || pool == nil {
+		return nil
+	}
+
+	backends := make([]*backendStats, len(pool.ServerList))
+	for i, server := range pool.ServerList {
+		counters := tunnelutil.GetBackendCounters(listener.Name, server.URL.Host)
+		backends[i] = &backendStats{
+			Endpoint:    server.URL.Host,
+			ActiveFlows: counters.GetActive(),
+			TotalFlows:  counters.GetTotal(),
+			BytesIn:     counters.GetBytesIn(),
+			BytesOut:    counters.GetBytesOut(),
+			PacketsIn:   counters.GetPacketsIn(),
+			PacketsOut:  counters.GetPacketsOut(),
+		}
+	}
+	return backends
+}
+
+func getEndpoints(pool *poolutil.ServerPool) []*endpoint {
+	endpoints := make([]*endpoint, len(pool.ServerList))
+	for i, server := range pool.ServerList {
+		effectiveWeight := pool.EffectiveWeight(server)
+		ejected := server.GetEjected()
+		breakerState := server.Breaker.State()
+		latency := server.Latency.Value()
+		server.Mux.RLock()
+		endpoints[i] = &endpoint{
+			URL:               server.URL.String(),
+			Active:            server.Alive,
+			Weight:            server.Weight,
+			EffectiveWeight:   math.Round(effectiveWeight*1000) / 1000,
+			Priority:          server.Priority,
+			ActiveConnections: server.GetActiveConnections(),
+			ActiveRequests:    server.GetInFlight(),
+			MaxConnections:    server.MaxConnections,
+			MaxRequests:       server.MaxRequests,
+			ServerHash:        server.ServerHash,
+			LastCheck:         getLastCheck(server.LastCheck),
+			Ejected:           ejected,
+			Ejections:         server.Ejections,
+			CircuitBreaker:    breakerState,
+			ResponseTimeEWMA:  math.Round(float64(latency.Microseconds())/10) / 100,
+		}
+		server.Mux.RUnlock()
+	}
+	return endpoints
+}
+
+func getTrafficStats(stats *routeutil.TrafficStats) *trafficStats {
+	responseTime := stats.GetAverageResponseTime()
+	return &trafficStats{
+		Requests:            stats.GetRequests(),
+		AverageResponseTime: math.Round(float64(responseTime.Microseconds())/10) / 100,
+		StatusCodes:         stats.StatusCodes.GetStatuses(),
+	}
+}
+
+func getLastCheck(result serverutil.CheckResult) *lastCheck {
+	if result.Time.IsZero() {
+		return nil
+	}
+	return &lastCheck{
+		Timestamp:  result.Time.Unix() * 1000,
+		Success:    result.Success,
+		StatusCode: result.StatusCode,
+		Latency:    math.Round(float64(result.Latency.Microseconds())/10) / 100,
+		Error:      result.Error,
+	}
+}
+
 //Metrics ...
 func Metrics(w http.ResponseWriter, r *http.Request) {
 	wd, err := os.Getwd()
@@ -0,0 +1,67 @@
+package poolutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples = 1024
+	//Percentiles are recalculated at most once per second
+	percentileTTL = time.Second
+)
+
+//LatencyWindow keeps the latest response times of the pool
+type LatencyWindow struct {
+	mux         sync.Mutex
+	samples     [latencySamples]time.Duration
+	next        int
+	filled      bool
+	percentiles map[float64]time.Duration
+	computedAt  time.Time
+}
+
+//Observe ...
+func (lw *LatencyWindow) Observe(latency time.Duration) {
+	lw.mux.Lock()
+	defer lw.mux.Unlock()
+
+	lw.samples[lw.next] = latency
+	lw.next = (lw.next + 1) % latencySamples
+	if lw.next == 0 {
+		lw.filled = true
+	}
+}
+
+//Percentile returns zero until there are any samples
+func (lw *LatencyWindow) Percentile(p float64) time.Duration {
+	lw.mux.Lock()
+	defer lw.mux.Unlock()
+
+	if time.Since(lw.computedAt) >= percentileTTL {
+		lw.percentiles = make(map[float64]time.Duration)
+		lw.computedAt = time.Now()
+	}
+	if val, ok := lw.percentiles[p]; ok {
+		return val
+	}
+
+	size := lw.next
+	if lw.filled {
+		size = latencySamples
+	}
+	if size == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, size)
+	copy(sorted, lw.samples[:size])
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	val := sorted[int(float64(size-1)*p/100)]
+	lw.percentiles[p] = val
+	return val
+}
@@ -0,0 +1,137 @@
+package poolutil
+
+import (
+	"balansir/internal/serverutil"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Prime lookup table size, big enough to keep the distribution even for a few hundreds of servers
+const maglevTableSize = 65537
+
+//Maglev is a consistent hashing lookup table.
+//See https://static.googleusercontent.com/media/research.google.com/en//pubs/archive/44824.pdf
+type Maglev struct {
+	mux         sync.RWMutex
+	fingerprint string
+	servers     []*serverutil.Server
+	table       []int32
+}
+
+//Get ...
+func (m *Maglev) Get(servers []*serverutil.Server, key string) *serverutil.Server {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	fingerprint := maglevFingerprint(servers)
+
+	m.mux.RLock()
+	if m.fingerprint == fingerprint {
+		server := m.lookup(key)
+		m.mux.RUnlock()
+		return server
+	}
+	m.mux.RUnlock()
+
+	//Lookup is done under the same lock the table is rebuilt with, otherwise another server set
+	//could take its place in between and the server returned wouldn't be one of the passed ones
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.fingerprint != fingerprint {
+		m.rebuild(servers, fingerprint)
+	}
+	return m.lookup(key)
+}
+
+func (m *Maglev) lookup(key string) *serverutil.Server {
+	return m.servers[m.table[hashKey(key)%uint64(len(m.table))]]
+}
+
+//rebuild must be called under the write lock
+func (m *Maglev) rebuild(servers []*serverutil.Server, fingerprint string) {
+	weights := make([]float64, len(servers))
+	for i, server := range servers {
+		weights[i] = server.Weight
+	}
+
+	m.servers = append([]*serverutil.Server{}, servers...)
+	m.table = populateMaglev(m.servers, weights, maglevTableSize)
+	m.fingerprint = fingerprint
+}
+
+func maglevFingerprint(servers []*serverutil.Server) string {
+	var b strings.Builder
+	for _, server := range servers {
+		b.WriteString(server.ServerHash)
+		b.WriteString(strconv.FormatFloat(server.Weight, 'f', -1, 64))
+	}
+	return b.String()
+}
+
+//Every server walks the table in its own permutation, derived from the server's URL only,
+//so adding or removing a server moves as few keys as possible
+func populateMaglev(servers []*serverutil.Server, weights []float64, size uint64) []int32 {
+	n := len(servers)
+	offsets := make([]uint64, n)
+	skips := make([]uint64, n)
+	next := make([]uint64, n)
+	credits := make([]float64, n)
+
+	maxWeight := 0.0
+	for i, server := range servers {
+		name := server.URL.String()
+		offsets[i] = hashKey(name) % size
+		skips[i] = hashKey(name+"#skip")%(size-1) + 1
+		if weights[i] > maxWeight {
+			maxWeight = weights[i]
+		}
+	}
+
+	//Servers without weight are treated equally
+	if maxWeight <= 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		maxWeight = 1
+	}
+
+	table := make([]int32, size)
+	for i := range table {
+		table[i] = -1
+	}
+
+	filled := uint64(0)
+	for {
+		for i := 0; i < n; i++ {
+			//Weighted servers claim slots proportionally to their weight
+			credits[i] += weights[i] / maxWeight
+			if credits[i] < 1 {
+				continue
+			}
+			credits[i]--
+
+			c := (offsets[i] + next[i]*skips[i]) % size
+			for table[c] >= 0 {
+				next[i]++
+				c = (offsets[i] + next[i]*skips[i]) % size
+			}
+			table[c] = int32(i)
+			next[i]++
+
+			filled++
+			if filled == size {
+				return table
+			}
+		}
+	}
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key)) //nolint
+	return h.Sum64()
+}
@@ -0,0 +1,80 @@
+package poolutil
+
+import (
+	"balansir/internal/serverutil"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func newMaglevServers(weights ...float64) []*serverutil.Server {
+	servers := make([]*serverutil.Server, len(weights))
+	for i, weight := range weights {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%v:80", i+1))
+		servers[i] = &serverutil.Server{URL: u, ServerHash: u.Host, Weight: weight, Alive: true}
+	}
+	return servers
+}
+
+func TestMaglevStability(t *testing.T) {
+	const keys = 10000
+
+	tests := []struct {
+		name    string
+		servers []*serverutil.Server
+		remove  int
+		//Share of the keys of the servers left in place that may move, in percents
+		maxMoved float64
+	}{
+		{name: "first of three", servers: newMaglevServers(1, 1, 1), remove: 0, maxMoved: 2},
+		{name: "middle of five", servers: newMaglevServers(1, 1, 1, 1, 1), remove: 2, maxMoved: 2},
+		{name: "last of ten", servers: newMaglevServers(1, 1, 1, 1, 1, 1, 1, 1, 1, 1), remove: 9, maxMoved: 2},
+		{name: "heaviest of weighted", servers: newMaglevServers(1, 3, 1, 2), remove: 1, maxMoved: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Maglev{}
+			before := make([]*serverutil.Server, keys)
+			for i := range before {
+				before[i] = m.Get(tt.servers, fmt.Sprintf("client-%v", i))
+			}
+
+			left := append(append([]*serverutil.Server{}, tt.servers[:tt.remove]...), tt.servers[tt.remove+1:]...)
+			removed := tt.servers[tt.remove]
+
+			var kept, moved int
+			for i := range before {
+				after := m.Get(left, fmt.Sprintf("client-%v", i))
+				if after == removed {
+					t.Fatalf("key %v is still on the removed server", i)
+				}
+				if before[i] == removed {
+					continue
+				}
+				kept++
+				if after != before[i] {
+					moved++
+				}
+			}
+
+			if share := float64(moved) * 100 / float64(kept); share > tt.maxMoved {
+				t.Errorf("got %.2f%% of the keys moved between the servers left, want %v%% at most", share, tt.maxMoved)
+			}
+		})
+	}
+}
+
+func TestMaglevWeights(t *testing.T) {
+	servers := newMaglevServers(1, 3)
+	m := &Maglev{}
+
+	counts := make(map[*serverutil.Server]int)
+	for i := 0; i < 40000; i++ {
+		counts[m.Get(servers, fmt.Sprintf("client-%v", i))]++
+	}
+
+	if ratio := float64(counts[servers[1]]) / float64(counts[servers[0]]); ratio < 2.7 || ratio > 3.3 {
+		t.Errorf("got %.2f keys of the heavier server per key of the lighter one, want 3", ratio)
+	}
+}
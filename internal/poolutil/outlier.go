@@ -0,0 +1,105 @@
+package poolutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/logutil"
+	"balansir/internal/serverutil"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultConsecutive5xx     = 5
+	defaultConsecutiveErrors  = 5
+	defaultBaseEjectionTime   = 30
+	defaultMaxEjectionTime    = 300
+	defaultMaxEjectionPercent = 10
+)
+
+type outlierSettings struct {
+	consecutive5xx     int
+	consecutiveErrors  int
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+}
+
+func getOutlierSettings(outlierDetection *configutil.OutlierDetection) outlierSettings {
+	settings := outlierSettings{
+		consecutive5xx:     outlierDetection.Consecutive5xx,
+		consecutiveErrors:  outlierDetection.ConsecutiveErrors,
+		baseEjectionTime:   time.Duration(outlierDetection.BaseEjectionTime) * time.Second,
+		maxEjectionTime:    time.Duration(outlierDetection.MaxEjectionTime) * time.Second,
+		maxEjectionPercent: outlierDetection.MaxEjectionPercent,
+	}
+
+	if settings.consecutive5xx <= 0 {
+		settings.consecutive5xx = defaultConsecutive5xx
+	}
+	if settings.consecutiveErrors <= 0 {
+		settings.consecutiveErrors = defaultConsecutiveErrors
+	}
+	if settings.baseEjectionTime <= 0 {
+		settings.baseEjectionTime = defaultBaseEjectionTime * time.Second
+	}
+	if settings.maxEjectionTime <= 0 {
+		settings.maxEjectionTime = defaultMaxEjectionTime * time.Second
+	}
+	if settings.maxEjectionTime < settings.baseEjectionTime {
+		settings.maxEjectionTime = settings.baseEjectionTime
+	}
+	if settings.maxEjectionPercent <= 0 {
+		settings.maxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	return settings
+}
+
+func (pool *ServerPool) detectOutlier(server *serverutil.Server, consecutive5xx int, consecutiveErrors int, err error) {
+	outlierDetection := &pool.GetUpstream().OutlierDetection
+	if !outlierDetection.Enabled {
+		return
+	}
+
+	settings := getOutlierSettings(outlierDetection)
+	if consecutive5xx >= settings.consecutive5xx {
+		pool.eject(server, settings, fmt.Sprintf("%v consecutive 5xx responses", consecutive5xx))
+	}
+	if consecutiveErrors >= settings.consecutiveErrors {
+		pool.eject(server, settings, fmt.Sprintf("%v consecutive errors, last one: %v", consecutiveErrors, err))
+	}
+}
+
+func (pool *ServerPool) eject(server *serverutil.Server, settings outlierSettings, reason string) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	if server.GetEjected() {
+		return
+	}
+
+	//At least one server may always be ejected, otherwise ejections are capped
+	//by the share of the pool
+	ejected := 0
+	for _, s := range pool.ServerList {
+		if s.GetEjected() {
+			ejected++
+		}
+	}
+	if ejected > 0 && (ejected+1)*100 > len(pool.ServerList)*settings.maxEjectionPercent {
+		logutil.Warning(fmt.Sprintf("Server %v is an outlier (%s), but max ejection percent is reached", server.URL.Host, reason))
+		return
+	}
+
+	duration := server.Eject(settings.baseEjectionTime, settings.maxEjectionTime)
+	logutil.Warning(fmt.Sprintf("Server ejected for %v: %v: %s", duration, server.URL.Host, reason))
+}
+
+//ReadmitServers ...
+func (pool *ServerPool) ReadmitServers() {
+	for _, server := range pool.ServerList {
+		if server.Readmit() {
+			logutil.Notice(fmt.Sprintf("Server readmitted after ejection: %v", server.URL.Host))
+		}
+	}
+}
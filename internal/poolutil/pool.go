@@ -2,12 +2,14 @@ package poolutil
 
 import (
 	"balansir/internal/configutil"
+	"balansir/internal/limitutil"
 	"balansir/internal/logutil"
+	"balansir/internal/proxyprotoutil"
 	"balansir/internal/proxyutil"
 	"balansir/internal/serverutil"
+	"balansir/internal/statusutil"
 	"crypto/md5"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -23,52 +25,120 @@ import (
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+//DefaultPoolName ...
+const DefaultPoolName = "default"
+
 //ServerPool ...
 type ServerPool struct {
-	Guard      sync.WaitGroup
-	ServerList []*serverutil.Server
-	Current    int64
-}
-
-//EndpointChoice ...
-type EndpointChoice struct {
-	Endpoint *serverutil.Server
-	Weight   int
+	Guard         sync.WaitGroup
+	Name          string
+	ServerList    []*serverutil.Server
+	Current       int64
+	StatusCodes   *statusutil.StatusCodes
+	Limiter       *limitutil.AdaptiveLimiter
+	RetryBudget   RetryBudget
+	HedgeBudget   RetryBudget
+	Latencies     LatencyWindow
+	Maglev        Maglev
+	Queue         Queue
+	upstream      *configutil.Upstream
+	healthChecker *serverutil.HealthChecker
+	settingsMux   sync.RWMutex
+	tier          int64
+	hedges        int64
+	mux           sync.Mutex
+	random        *rand.Rand
+	randomMux     sync.Mutex
+	weightMux     sync.Mutex
 }
 
 var pool *ServerPool
 var once sync.Once
 
+var pools = make(map[string]*ServerPool)
+var poolsMux sync.RWMutex
+
 //GetPool ...
 func GetPool() *ServerPool {
 	once.Do(func() {
-		pool = &ServerPool{}
+		pool = &ServerPool{
+			Name:        DefaultPoolName,
+			upstream:    &configutil.Upstream{Name: DefaultPoolName},
+			StatusCodes: statusutil.NewStatusCodes(),
+			Limiter:     &limitutil.AdaptiveLimiter{},
+		}
 	})
 
 	return pool
 }
 
+//GetUpstream ...
+func (pool *ServerPool) GetUpstream() *configutil.Upstream {
+	pool.settingsMux.RLock()
+	defer pool.settingsMux.RUnlock()
+	return pool.upstream
+}
+
+//GetHealthChecker ...
+func (pool *ServerPool) GetHealthChecker() *serverutil.HealthChecker {
+	pool.settingsMux.RLock()
+	defer pool.settingsMux.RUnlock()
+	return pool.healthChecker
+}
+
+//SetUpstream replaces the settings of the pool, it's safe to call while the pool is serving
+func (pool *ServerPool) SetUpstream(upstream *configutil.Upstream, checker *serverutil.HealthChecker) {
+	pool.settingsMux.Lock()
+	defer pool.settingsMux.Unlock()
+	pool.upstream = upstream
+	pool.healthChecker = checker
+}
+
 //SetPool ...
 func SetPool(newPool *ServerPool) {
 	pool = newPool
 }
 
-//GetPoolChoice ...
-func (pool *ServerPool) GetPoolChoice() []EndpointChoice {
-	choice := []EndpointChoice{}
-	serverList := pool.ExcludeZeroWeightServers()
-	serverList = ExcludeUnavailableServers(serverList)
-	for _, server := range serverList {
-		weight := int(server.Weight * 100)
-		choice = append(choice, EndpointChoice{Weight: weight, Endpoint: server})
+//GetPoolByName ...
+func GetPoolByName(name string) *ServerPool {
+	if name == DefaultPoolName {
+		return GetPool()
 	}
 
-	return choice
+	poolsMux.RLock()
+	defer poolsMux.RUnlock()
+	return pools[name]
+}
+
+//SetPools replaces all named pools
+func SetPools(newPools map[string]*ServerPool) {
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	pools = newPools
+}
+
+//GetPools returns default pool followed by the named ones
+func GetPools() []*ServerPool {
+	poolsMux.RLock()
+	defer poolsMux.RUnlock()
+
+	list := make([]*ServerPool, 0, len(pools)+1)
+	for _, p := range pools {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return append([]*ServerPool{GetPool()}, list...)
 }
 
 //ExcludeZeroWeightServers ...
 func (pool *ServerPool) ExcludeZeroWeightServers() []*serverutil.Server {
-	servers := pool.ServerList
+	return excludeZeroWeight(pool.ServerList)
+}
+
+func excludeZeroWeight(servers []*serverutil.Server) []*serverutil.Server {
 	serverList := make([]*serverutil.Server, 0)
 	for _, server := range servers {
 		if server.Weight > 0 {
@@ -83,7 +153,19 @@ func (pool *ServerPool) ExcludeZeroWeightServers() []*serverutil.Server {
 func ExcludeUnavailableServers(servers []*serverutil.Server) []*serverutil.Server {
 	serverList := make([]*serverutil.Server, 0)
 	for _, server := range servers {
-		if server.GetAlive() {
+		if server.Available() {
+			serverList = append(serverList, server)
+		}
+	}
+
+	return serverList
+}
+
+//GetBusyServers returns servers at their max requests limit
+func GetBusyServers(servers []*serverutil.Server) []*serverutil.Server {
+	serverList := make([]*serverutil.Server, 0)
+	for _, server := range servers {
+		if !server.HasCapacity() {
 			serverList = append(serverList, server)
 		}
 	}
@@ -91,52 +173,157 @@ func ExcludeUnavailableServers(servers []*serverutil.Server) []*serverutil.Serve
 	return serverList
 }
 
-//WeightedChoice ...
-func WeightedChoice(choices []EndpointChoice) (*serverutil.Server, error) {
-	rand.Seed(time.Now().UnixNano())
-	weightSum := 0
-	for _, choice := range choices {
-		weightSum += choice.Weight
+//ExcludeServers ...
+func ExcludeServers(servers []*serverutil.Server, excluded []*serverutil.Server) []*serverutil.Server {
+	if len(excluded) == 0 {
+		return servers
 	}
-	randint := rand.Intn(weightSum)
 
-	sort.Slice(choices, func(i, j int) bool {
-		return choices[i].Weight > choices[j].Weight
-	})
+	serverList := make([]*serverutil.Server, 0, len(servers))
+	for _, server := range servers {
+		skip := false
+		for _, e := range excluded {
+			if server == e {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			serverList = append(serverList, server)
+		}
+	}
+
+	return serverList
+}
+
+//GetSmoothWeightedServer implements nginx smooth weighted round-robin:
+//every pick each server's current weight grows by its weight, the heaviest one is chosen
+//and its current weight is lowered by the total, which interleaves servers evenly
+func (pool *ServerPool) GetSmoothWeightedServer(servers []*serverutil.Server) *serverutil.Server {
+	return pool.getSmoothWeightedServer(servers, pool.EffectiveWeight)
+}
+
+func (pool *ServerPool) getSmoothWeightedServer(servers []*serverutil.Server, weightOf func(*serverutil.Server) float64) *serverutil.Server {
+	pool.weightMux.Lock()
+	defer pool.weightMux.Unlock()
 
-	for _, choice := range choices {
-		if choice.Weight == 100 {
-			return choice.Endpoint, nil
+	var best *serverutil.Server
+	total := 0.0
+	for _, server := range servers {
+		weight := weightOf(server)
+		if weight <= 0 {
+			continue
 		}
-		randint -= choice.Weight
-		if randint <= 0 {
-			return choice.Endpoint, nil
+		server.CurrentWeight += weight
+		total += weight
+		if best == nil || server.CurrentWeight > best.CurrentWeight {
+			best = server
 		}
 	}
-	return &serverutil.Server{}, errors.New("no server returned from weighted random selection")
+
+	if best == nil {
+		return nil
+	}
+	best.CurrentWeight -= total
+	return best
 }
 
 //GetWeightedLeastConnectedServer ...
-func (pool *ServerPool) GetWeightedLeastConnectedServer() *serverutil.Server {
-	servers := pool.ExcludeZeroWeightServers()
-	serverList := ExcludeUnavailableServers(servers)
+func (pool *ServerPool) GetWeightedLeastConnectedServer(servers []*serverutil.Server) *serverutil.Server {
+	serverList := excludeZeroWeight(servers)
+	if len(serverList) == 0 {
+		return nil
+	}
+	load := make(map[*serverutil.Server]float64, len(serverList))
+	for _, server := range serverList {
+		load[server] = float64(server.GetActiveConnections()+1) / pool.EffectiveWeight(server)
+	}
 	sort.Slice(serverList, func(i, j int) bool {
-		return (float64(serverList[i].GetActiveConnections()) / serverList[i].Weight) < (float64(serverList[j].GetActiveConnections()) / serverList[j].Weight)
+		return load[serverList[i]] < load[serverList[j]]
 	})
 
 	return serverList[0]
 }
 
 //GetLeastConnectedServer ...
-func (pool *ServerPool) GetLeastConnectedServer() *serverutil.Server {
-	serverList := pool.ServerList
-	serverList = ExcludeUnavailableServers(serverList)
+func (pool *ServerPool) GetLeastConnectedServer(servers []*serverutil.Server) *serverutil.Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	serverList := make([]*serverutil.Server, len(servers))
+	copy(serverList, servers)
+	load := make(map[*serverutil.Server]float64, len(serverList))
+	for _, server := range serverList {
+		load[server] = float64(server.GetActiveConnections()+1) / pool.SlowStartFactor(server)
+	}
 	sort.Slice(serverList, func(i, j int) bool {
-		return serverList[i].GetActiveConnections() < serverList[j].GetActiveConnections()
+		return load[serverList[i]] < load[serverList[j]]
 	})
 	return serverList[0]
 }
 
+//GetNextServer ...
+func (pool *ServerPool) GetNextServer(servers []*serverutil.Server) *serverutil.Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	//Warming up servers are interleaved in proportion to their slow start factor
+	if pool.warmingUp(servers) {
+		return pool.getSmoothWeightedServer(servers, pool.SlowStartFactor)
+	}
+	return servers[int(atomic.AddInt64(&pool.Current, 1)%int64(len(servers)))]
+}
+
+//GetP2CServer picks two random servers and returns the one with lower latency and load score
+func (pool *ServerPool) GetP2CServer(servers []*serverutil.Server) *serverutil.Server {
+	switch len(servers) {
+	case 0:
+		return nil
+	case 1:
+		return servers[0]
+	}
+
+	pool.randomMux.Lock()
+	if pool.random == nil {
+		pool.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	i := pool.random.Intn(len(servers))
+	j := pool.random.Intn(len(servers) - 1)
+	pool.randomMux.Unlock()
+
+	if j >= i {
+		j++
+	}
+
+	//Servers without samples are taken for the pool's median
+	fallback := pool.Latencies.Percentile(50)
+	best, other := servers[i], servers[j]
+	if other.GetScore(fallback) < best.GetScore(fallback) {
+		best, other = other, best
+	}
+
+	//Warming up server gives its turn away in proportion to the missing share of weight
+	if factor := pool.SlowStartFactor(best); factor < 1 {
+		pool.randomMux.Lock()
+		skip := pool.random.Float64() >= factor
+		pool.randomMux.Unlock()
+		if skip {
+			return other
+		}
+	}
+	return best
+}
+
+//HitHedge ...
+func (pool *ServerPool) HitHedge() {
+	atomic.AddInt64(&pool.hedges, 1)
+}
+
+//GetHedges ...
+func (pool *ServerPool) GetHedges() int64 {
+	return atomic.LoadInt64(&pool.hedges)
+}
+
 //GetServerByHash ...
 func (pool *ServerPool) GetServerByHash(hash string) (*serverutil.Server, error) {
 	serverList := pool.ServerList
@@ -158,24 +345,42 @@ func (pool *ServerPool) ClearPool() {
 	pool.ServerList = nil
 }
 
-//NextPool ...
-func (pool *ServerPool) NextPool() int {
-	return int(atomic.AddInt64(&pool.Current, 1) % int64(len(pool.ServerList)))
-}
-
 //RedefineServerPool ...
-func RedefineServerPool(configuration *configutil.Configuration, serverPoolGuard *sync.WaitGroup) (*ServerPool, error) {
+func RedefineServerPool(upstream *configutil.Upstream, oldPool *ServerPool) (*ServerPool, error) {
 	var serverHash string
-	serverPoolGuard.Add(len(configuration.ServerList))
+	oldPool.Guard.Add(len(upstream.ServerList))
+
+	//Smooth weighted round-robin, slow start, health, ejection and circuit breaker state is carried over for the servers that remain in the pool
+	currentWeights := make(map[string]float64)
+	aliveSince := make(map[string]time.Time)
+	oldServers := make(map[string]*serverutil.Server)
+	oldPool.weightMux.Lock()
+	for _, server := range oldPool.ServerList {
+		currentWeights[server.URL.String()] = server.CurrentWeight
+		aliveSince[server.URL.String()] = server.GetAliveSince()
+		oldServers[server.URL.String()] = server
+	}
+	oldPool.weightMux.Unlock()
+
+	newPool := &ServerPool{
+		Name:          upstream.Name,
+		upstream:      upstream,
+		healthChecker: oldPool.GetHealthChecker(),
+		StatusCodes:   oldPool.StatusCodes,
+		Limiter:       oldPool.Limiter,
+	}
+	if newPool.StatusCodes == nil {
+		newPool.StatusCodes = statusutil.NewStatusCodes()
+	}
+	if newPool.Limiter == nil {
+		newPool.Limiter = &limitutil.AdaptiveLimiter{}
+	}
 
-	newPool := &ServerPool{}
-	for index, server := range configuration.ServerList {
-		switch configuration.Algorithm {
+	for index, server := range upstream.ServerList {
+		switch upstream.Algorithm {
 		case "weighted-round-robin", "weighted-least-connections":
 			if server.Weight < 0 {
-				return nil, fmt.Errorf(`negative weight (%v) is specified for (%s) endpoint in config["server_list"]. Please set it's the weight to 0 if you want to mark it as dead one`, server.Weight, server.URL)
-			} else if server.Weight > 1 {
-				return nil, fmt.Errorf(`weight can't be greater than 1. You specified (%v) weight for (%s) endpoint in config["server_list"]`, server.Weight, server.URL)
+				return nil, fmt.Errorf(`negative weight (%v) is specified for (%s) endpoint in (%s) upstream server list. Please set it's the weight to 0 if you want to mark it as dead one`, server.Weight, server.URL, upstream.Name)
 			}
 		}
 
@@ -187,36 +392,67 @@ func RedefineServerPool(configuration *configutil.Configuration, serverPoolGuard
 		proxy := httputil.NewSingleHostReverseProxy(serverURL)
 		proxy.Transport = &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   time.Duration(configuration.WriteTimeout) * time.Second,
-				KeepAlive: time.Duration(configuration.ReadTimeout) * time.Second,
-			}).DialContext,
+			DialContext: proxyprotoutil.Dialer((&net.Dialer{
+				Timeout:   time.Duration(upstream.WriteTimeout) * time.Second,
+				KeepAlive: time.Duration(upstream.ReadTimeout) * time.Second,
+			}).DialContext),
 			MaxIdleConns:        100,
 			MaxIdleConnsPerHost: 100,
+			//Requests over max connections are queued before they get here, the transport's cap is only a backstop
+			MaxConnsPerHost: server.MaxConnections,
+			//PROXY protocol header carries a single client's address, so the connection can't be reused for the others
+			DisableKeepAlives: upstream.SendProxyProtocol != "",
 		}
 
-		proxy.ModifyResponse = proxyutil.ModifyResponse
-		proxy.ErrorHandler = proxyutil.ErrorHandler
-
 		md := md5.Sum([]byte(serverURL.String()))
 		serverHash = hex.EncodeToString(md[:16])
 
-		newPool.AddServer(&serverutil.Server{
-			URL:        serverURL,
-			Weight:     server.Weight,
-			Index:      index,
-			Alive:      true,
-			Proxy:      proxy,
-			ServerHash: serverHash,
-		})
-		serverPoolGuard.Done()
+		endpoint := &serverutil.Server{
+			URL:            serverURL,
+			Weight:         server.Weight,
+			Priority:       server.Priority,
+			MaxConnections: server.MaxConnections,
+			MaxRequests:    server.MaxRequests,
+			CurrentWeight:  currentWeights[serverURL.String()],
+			Index:          index,
+			Alive:          true,
+			Proxy:          proxy,
+			ServerHash:     serverHash,
+			Breaker:        &serverutil.CircuitBreaker{},
+		}
+
+		if old, ok := oldServers[serverURL.String()]; ok {
+			endpoint.InheritHealth(old)
+			endpoint.InheritEjection(old)
+			//Breaker is shared, so the requests still in flight on the old server are counted as well
+			endpoint.Breaker = old.Breaker
+		}
+
+		//Servers added to a running pool start slowly, the initial ones get full weight at once
+		if since, ok := aliveSince[serverURL.String()]; ok {
+			endpoint.SetAliveSince(since)
+		} else if len(oldPool.ServerList) > 0 {
+			endpoint.SetAliveSince(time.Now())
+		}
+
+		proxy.ModifyResponse = func(r *http.Response) error {
+			newPool.ReportStatus(endpoint, r.StatusCode)
+			return proxyutil.ModifyResponse(r)
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			newPool.ReportError(endpoint, err)
+			proxyutil.ErrorHandler(w, r, err)
+		}
+
+		newPool.AddServer(endpoint)
+		oldPool.Guard.Done()
 	}
 
-	switch configuration.Algorithm {
+	switch upstream.Algorithm {
 	case "weighted-round-robin", "weighted-least-connections":
 		nonZeroServers := newPool.ExcludeZeroWeightServers()
 		if len(nonZeroServers) <= 0 {
-			return nil, fmt.Errorf(`0 weight is specified for all your endpoints in config["server_list"]. Please consider adding at least one endpoint with non-zero weight`)
+			return nil, fmt.Errorf(`0 weight is specified for all your endpoints in (%s) upstream server list. Please consider adding at least one endpoint with non-zero weight`, upstream.Name)
 		}
 	}
 
@@ -225,28 +461,35 @@ func RedefineServerPool(configuration *configutil.Configuration, serverPoolGuard
 
 //PoolCheck ...
 func PoolCheck() {
-	configuration := configutil.GetConfig()
-	timer := time.NewTicker(time.Duration(configuration.Delay) * time.Second)
+	lastChecks := make(map[string]time.Time)
+	timer := time.NewTicker(1 * time.Second)
 	for {
 		<-timer.C
 
-		pool.Guard.Wait()
-		inActive := 0
+		for _, pool := range GetPools() {
+			delay := time.Duration(pool.GetUpstream().Delay) * time.Second
+			checker := pool.GetHealthChecker()
+			if time.Since(lastChecks[pool.Name]) < delay || checker == nil {
+				continue
+			}
+			lastChecks[pool.Name] = time.Now()
+
+			pool.Guard.Wait()
+			inActive := 0
 
-		for _, server := range pool.ServerList {
-			active := server.CheckAlive(&configuration.Timeout)
-			if !active {
-				inActive++
+			for _, server := range pool.ServerList {
+				active := server.CheckAlive(checker)
+				if !active {
+					inActive++
+				}
 			}
-		}
 
-		if inActive == len(pool.ServerList) {
-			logutil.Error("All servers are down!")
-		}
+			if len(pool.ServerList) > 0 && inActive == len(pool.ServerList) {
+				logutil.Error(fmt.Sprintf("All servers are down in (%s) upstream!", pool.Name))
+			}
 
-		configuration.Mux.Lock()
-		timer = time.NewTicker(time.Duration(configuration.Delay) * time.Second)
-		configuration.Mux.Unlock()
+			pool.ReadmitServers()
+		}
 	}
 }
 
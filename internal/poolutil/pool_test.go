@@ -0,0 +1,170 @@
+package poolutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/serverutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetSmoothWeightedServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []float64
+		picks   int
+		want    string
+	}{
+		{name: "nginx example", weights: []float64{5, 1, 1}, picks: 14, want: "aabacaaaabacaa"},
+		{name: "equal weights", weights: []float64{1, 1, 1}, picks: 6, want: "abcabc"},
+		{name: "fractional weights", weights: []float64{0.5, 0.25, 0.25}, picks: 8, want: "abcaabca"},
+		{name: "zero weight is skipped", weights: []float64{2, 0, 1}, picks: 6, want: "acaaca"},
+		{name: "single server", weights: []float64{3}, picks: 3, want: "aaa"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := make([]*serverutil.Server, len(tt.weights))
+			names := make(map[*serverutil.Server]string)
+			for i, weight := range tt.weights {
+				servers[i] = &serverutil.Server{Weight: weight, Alive: true}
+				names[servers[i]] = string(rune('a' + i))
+			}
+
+			pool := &ServerPool{upstream: &configutil.Upstream{}}
+			var got strings.Builder
+			for i := 0; i < tt.picks; i++ {
+				got.WriteString(names[pool.GetSmoothWeightedServer(servers)])
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSmoothWeightedServerNoWeight(t *testing.T) {
+	pool := &ServerPool{upstream: &configutil.Upstream{}}
+	servers := []*serverutil.Server{{Weight: 0}, {Weight: 0}}
+	if got := pool.GetSmoothWeightedServer(servers); got != nil {
+		t.Errorf("got %v, want no server", got)
+	}
+	if got := pool.GetSmoothWeightedServer(nil); got != nil {
+		t.Errorf("got %v, want no server", got)
+	}
+}
+
+func newTestServer(latency time.Duration, pending int) *serverutil.Server {
+	server := &serverutil.Server{Alive: true, Weight: 1}
+	if latency > 0 {
+		server.Latency.Observe(latency)
+	}
+	for i := 0; i < pending; i++ {
+		server.IncreaseActiveConnections()
+	}
+	return server
+}
+
+func TestGetP2CServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		servers func() (want, other *serverutil.Server)
+	}{
+		{
+			name:    "lower latency wins",
+			samples: []time.Duration{20 * time.Millisecond},
+			servers: func() (*serverutil.Server, *serverutil.Server) {
+				return newTestServer(10*time.Millisecond, 0), newTestServer(50*time.Millisecond, 0)
+			},
+		},
+		{
+			name:    "pending requests outweigh lower latency",
+			samples: []time.Duration{20 * time.Millisecond},
+			servers: func() (*serverutil.Server, *serverutil.Server) {
+				return newTestServer(30*time.Millisecond, 0), newTestServer(10*time.Millisecond, 4)
+			},
+		},
+		{
+			name:    "unsampled server with pending requests loses",
+			samples: []time.Duration{10 * time.Millisecond},
+			servers: func() (*serverutil.Server, *serverutil.Server) {
+				return newTestServer(10*time.Millisecond, 0), newTestServer(0, 3)
+			},
+		},
+		{
+			name:    "unsampled server is taken for pool median",
+			samples: []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 200 * time.Millisecond},
+			servers: func() (*serverutil.Server, *serverutil.Server) {
+				return newTestServer(0, 0), newTestServer(200*time.Millisecond, 0)
+			},
+		},
+		{
+			name: "unsampled server in unsampled pool with pending requests loses",
+			servers: func() (*serverutil.Server, *serverutil.Server) {
+				return newTestServer(50*time.Millisecond, 0), newTestServer(0, 1)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &ServerPool{upstream: &configutil.Upstream{}}
+			for _, sample := range tt.samples {
+				pool.Latencies.Observe(sample)
+			}
+
+			want, other := tt.servers()
+			//Both servers are compared on every pick, so the order they are drawn in doesn't matter
+			for i := 0; i < 100; i++ {
+				if got := pool.GetP2CServer([]*serverutil.Server{want, other}); got != want {
+					t.Fatalf("pick %v: got server scored %v, want one scored %v", i, got.GetScore(0), want.GetScore(0))
+				}
+			}
+		})
+	}
+}
+
+func newTestUpstream(urls ...string) *configutil.Upstream {
+	upstream := &configutil.Upstream{Name: "test"}
+	for _, u := range urls {
+		upstream.ServerList = append(upstream.ServerList, &configutil.Endpoint{URL: u, Weight: 1})
+	}
+	return upstream
+}
+
+func TestRedefineServerPoolKeepsState(t *testing.T) {
+	oldPool, err := RedefineServerPool(newTestUpstream("10.0.0.1:80", "10.0.0.2:80"), &ServerPool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPool.ServerList[0].SetAlive(false)
+	oldPool.ServerList[0].Eject(time.Minute, time.Hour)
+	settings := serverutil.GetBreakerSettings(&configutil.CircuitBreaker{Enabled: true, MinRequests: 1})
+	oldPool.ServerList[0].Breaker.Record(false, settings)
+
+	newPool, err := RedefineServerPool(newTestUpstream("10.0.0.1:80", "10.0.0.3:80"), oldPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, added := newPool.ServerList[0], newPool.ServerList[1]
+	if kept.GetAlive() {
+		t.Error("dead server is brought back alive by the reload")
+	}
+	if !kept.GetEjected() || kept.GetEjections() != 1 {
+		t.Error("ejected server is readmitted by the reload")
+	}
+	if kept.Breaker != oldPool.ServerList[0].Breaker || kept.Breaker.State() != serverutil.BreakerOpen {
+		t.Error("circuit breaker of the kept server isn't carried over")
+	}
+	if !added.GetAlive() {
+		t.Error("added server isn't alive")
+	}
+	if added.GetEjected() {
+		t.Error("added server is ejected")
+	}
+	if added.Breaker.State() != serverutil.BreakerClosed {
+		t.Error("added server's circuit breaker isn't closed")
+	}
+}
@@ -0,0 +1,54 @@
+package poolutil
+
+import (
+	"balansir/internal/logutil"
+	"balansir/internal/serverutil"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+//AvailableServers returns available servers of the highest priority tiers. Lower priority
+//tiers join in once the share of available servers in the higher ones drops below
+//min healthy percent, or when none of them is available.
+func (pool *ServerPool) AvailableServers() []*serverutil.Server {
+	tiers := make(map[int][]*serverutil.Server)
+	priorities := make([]int, 0)
+	for _, server := range pool.ServerList {
+		if _, ok := tiers[server.Priority]; !ok {
+			priorities = append(priorities, server.Priority)
+		}
+		tiers[server.Priority] = append(tiers[server.Priority], server)
+	}
+	sort.Ints(priorities)
+
+	available := make([]*serverutil.Server, 0)
+	total := 0
+	for i, priority := range priorities {
+		total += len(tiers[priority])
+		available = append(available, ExcludeUnavailableServers(tiers[priority])...)
+
+		if len(available) == 0 {
+			continue
+		}
+		if len(available)*100 >= total*pool.GetUpstream().MinHealthyPercent || i == len(priorities)-1 {
+			pool.logTier(i, priority)
+			break
+		}
+	}
+
+	return available
+}
+
+func (pool *ServerPool) logTier(tier int, priority int) {
+	previous := atomic.SwapInt64(&pool.tier, int64(tier))
+	if previous == int64(tier) {
+		return
+	}
+
+	if previous < int64(tier) {
+		logutil.Warning(fmt.Sprintf("Upstream (%s) spills over to servers with priority %v", pool.Name, priority))
+	} else {
+		logutil.Notice(fmt.Sprintf("Upstream (%s) is back to servers with priority %v", pool.Name, priority))
+	}
+}
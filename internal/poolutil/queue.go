@@ -0,0 +1,165 @@
+package poolutil
+
+import (
+	"balansir/internal/serverutil"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultQueueTimeout = 1000
+	defaultRetryAfter   = 1
+)
+
+//ErrQueueFull ...
+var ErrQueueFull = errors.New("request queue is full")
+
+//ErrQueueTimeout ...
+var ErrQueueTimeout = errors.New("request queue timeout")
+
+//Queue holds requests waiting for a server with free capacity in FIFO order
+type Queue struct {
+	mux      sync.Mutex
+	waiters  *list.List
+	signaled bool
+	waited   int64
+	waitTime int64
+	timeouts int64
+	rejected int64
+}
+
+//QueueTimeout ...
+func (pool *ServerPool) QueueTimeout() time.Duration {
+	timeout := pool.GetUpstream().Queue.Timeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+//RetryAfter ...
+func (pool *ServerPool) RetryAfter() int {
+	if pool.GetUpstream().Queue.RetryAfter <= 0 {
+		return defaultRetryAfter
+	}
+	return pool.GetUpstream().Queue.RetryAfter
+}
+
+//Release frees the server's request slot and lets the next queued request in
+func (pool *ServerPool) Release(server *serverutil.Server) {
+	server.Release()
+	pool.Queue.notify()
+}
+
+//Wait blocks until a request slot is released somewhere in the pool. Requests that have already
+//waited get back to the head of the queue, so newcomers don't overtake them.
+func (q *Queue) Wait(ctx context.Context, size int, deadline time.Time, requeued bool) error {
+	q.mux.Lock()
+	if q.waiters == nil {
+		q.waiters = list.New()
+	}
+	if !requeued && q.waiters.Len() >= size {
+		q.mux.Unlock()
+		atomic.AddInt64(&q.rejected, 1)
+		return ErrQueueFull
+	}
+	//Slot might've been released after the caller had found no capacity
+	if q.signaled {
+		q.signaled = false
+		q.mux.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{}, 1)
+	var elem *list.Element
+	if requeued {
+		elem = q.waiters.PushFront(ready)
+	} else {
+		elem = q.waiters.PushBack(ready)
+	}
+	q.mux.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		atomic.AddInt64(&q.waited, 1)
+		atomic.AddInt64(&q.waitTime, int64(time.Since(start)))
+		return nil
+	case <-timer.C:
+		q.leave(elem, ready)
+		atomic.AddInt64(&q.timeouts, 1)
+		return ErrQueueTimeout
+	case <-ctx.Done():
+		q.leave(elem, ready)
+		return ctx.Err()
+	}
+}
+
+//Waiter that gives up right after being notified passes the notification on
+func (q *Queue) leave(elem *list.Element, ready chan struct{}) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	select {
+	case <-ready:
+		q.notifyLocked()
+	default:
+		q.waiters.Remove(elem)
+	}
+}
+
+func (q *Queue) notify() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.notifyLocked()
+}
+
+func (q *Queue) notifyLocked() {
+	if q.waiters == nil || q.waiters.Len() == 0 {
+		q.signaled = true
+		return
+	}
+	ready := q.waiters.Remove(q.waiters.Front()).(chan struct{})
+	ready <- struct{}{}
+}
+
+//Queued reports whether there are requests waiting
+func (q *Queue) Queued() bool {
+	return q.GetDepth() > 0
+}
+
+//GetDepth ...
+func (q *Queue) GetDepth() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.waiters == nil {
+		return 0
+	}
+	return q.waiters.Len()
+}
+
+//GetAverageWaitTime ...
+func (q *Queue) GetAverageWaitTime() time.Duration {
+	waited := atomic.LoadInt64(&q.waited)
+	if waited == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&q.waitTime) / waited)
+}
+
+//GetTimeouts ...
+func (q *Queue) GetTimeouts() int64 {
+	return atomic.LoadInt64(&q.timeouts)
+}
+
+//GetRejected ...
+func (q *Queue) GetRejected() int64 {
+	return atomic.LoadInt64(&q.rejected)
+}
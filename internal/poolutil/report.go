@@ -0,0 +1,83 @@
+package poolutil
+
+import (
+	"balansir/internal/limitutil"
+	"balansir/internal/logutil"
+	"balansir/internal/serverutil"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ReportStatus ...
+func (pool *ServerPool) ReportStatus(server *serverutil.Server, statusCode int) {
+	pool.StatusCodes.HitStatus(statusCode)
+	consecutive5xx := server.HitStatus(statusCode)
+	pool.detectOutlier(server, consecutive5xx, 0, nil)
+	pool.recordBreaker(server, statusCode < 500)
+}
+
+//ReportError ...
+func (pool *ServerPool) ReportError(server *serverutil.Server, err error) {
+	//Client cancelled the request, backend is not the one to blame
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	consecutiveErrors := server.HitError()
+	pool.detectOutlier(server, 0, consecutiveErrors, err)
+	pool.recordBreaker(server, false)
+
+	if adaptive := limitutil.GetAdaptiveSettings(&pool.GetUpstream().AdaptiveConcurrency); adaptive.Enabled {
+		pool.Limiter.Drop(adaptive)
+	}
+}
+
+//ReportConnect records the connection established to the layer 4 backend.
+//Connect time stands for the backend's latency.
+func (pool *ServerPool) ReportConnect(server *serverutil.Server, latency time.Duration) {
+	server.HitConnect()
+	pool.recordBreaker(server, true)
+	pool.ReportLatency(server, latency)
+}
+
+//ReportLatency ...
+func (pool *ServerPool) ReportLatency(server *serverutil.Server, latency time.Duration) {
+	server.Latency.Observe(latency)
+	pool.Latencies.Observe(latency)
+
+	if adaptive := limitutil.GetAdaptiveSettings(&pool.GetUpstream().AdaptiveConcurrency); adaptive.Enabled {
+		pool.Limiter.Sample(latency, adaptive)
+	}
+
+	settings := serverutil.GetBreakerSettings(&pool.GetUpstream().CircuitBreaker)
+	if !settings.Enabled {
+		return
+	}
+
+	if state, changed := server.Breaker.RecordLatency(latency, settings); changed {
+		logBreakerState(server, state)
+	}
+}
+
+func (pool *ServerPool) recordBreaker(server *serverutil.Server, success bool) {
+	settings := serverutil.GetBreakerSettings(&pool.GetUpstream().CircuitBreaker)
+	if !settings.Enabled {
+		server.Breaker.Reset()
+		return
+	}
+
+	if state, changed := server.Breaker.Record(success, settings); changed {
+		logBreakerState(server, state)
+	}
+}
+
+func logBreakerState(server *serverutil.Server, state string) {
+	switch state {
+	case serverutil.BreakerClosed:
+		logutil.Notice(fmt.Sprintf("Circuit breaker closed: %v", server.URL.Host))
+	default:
+		logutil.Warning(fmt.Sprintf("Circuit breaker opened: %v", server.URL.Host))
+	}
+}
@@ -0,0 +1,64 @@
+package poolutil
+
+import (
+	"sync"
+	"time"
+)
+
+//RetryBudget ...
+type RetryBudget struct {
+	mux       sync.Mutex
+	timestamp int64
+	requests  [2]int64
+	retries   int64
+}
+
+func (rb *RetryBudget) tick() {
+	now := time.Now().Unix()
+	if rb.timestamp == now {
+		return
+	}
+
+	//Keep previous second around, so the budget doesn't drop to zero
+	//at the beginning of every window
+	if rb.timestamp == now-1 {
+		rb.requests[0] = rb.requests[1]
+	} else {
+		rb.requests[0] = 0
+	}
+	rb.requests[1] = 0
+	rb.retries = 0
+	rb.timestamp = now
+}
+
+//HitRequest ...
+func (rb *RetryBudget) HitRequest() {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+
+	rb.tick()
+	rb.requests[1]++
+}
+
+//Withdraw ...
+func (rb *RetryBudget) Withdraw(percent int, minPerSecond int) bool {
+	rb.mux.Lock()
+	defer rb.mux.Unlock()
+
+	rb.tick()
+	requests := rb.requests[1]
+	if rb.requests[0] > requests {
+		requests = rb.requests[0]
+	}
+
+	allowed := requests * int64(percent) / 100
+	if allowed < int64(minPerSecond) {
+		allowed = int64(minPerSecond)
+	}
+	if rb.retries >= allowed {
+		return false
+	}
+
+	rb.retries++
+	return true
+}
@@ -0,0 +1,63 @@
+package poolutil
+
+import (
+	"balansir/internal/serverutil"
+	"time"
+)
+
+const defaultSlowStartMinPercent = 10
+
+//SlowStartFactor returns the share of the weight a server gets within the slow start window.
+//It grows linearly from the min weight percent up to 1 once the window is over.
+func (pool *ServerPool) SlowStartFactor(server *serverutil.Server) float64 {
+	slowStart := pool.GetUpstream().SlowStart
+	if slowStart.Window <= 0 {
+		return 1
+	}
+
+	since := server.GetAliveSince()
+	if since.IsZero() {
+		return 1
+	}
+
+	window := time.Duration(slowStart.Window) * time.Second
+	elapsed := time.Since(since)
+	if elapsed >= window {
+		return 1
+	}
+
+	minPercent := slowStart.MinWeightPercent
+	if minPercent <= 0 {
+		minPercent = defaultSlowStartMinPercent
+	}
+	if minPercent >= 100 {
+		return 1
+	}
+
+	min := float64(minPercent) / 100
+	return min + (1-min)*float64(elapsed)/float64(window)
+}
+
+//EffectiveWeight ...
+func (pool *ServerPool) EffectiveWeight(server *serverutil.Server) float64 {
+	return server.Weight * pool.SlowStartFactor(server)
+}
+
+//SlowStartKeeps tells whether a warming up server keeps the given hash key. Keys are
+//dropped deterministically, so the server gets back the same keys as its factor grows.
+func (pool *ServerPool) SlowStartKeeps(server *serverutil.Server, key string) bool {
+	factor := pool.SlowStartFactor(server)
+	if factor >= 1 {
+		return true
+	}
+	return float64(hashKey(key+"#slow-start")%10000)/10000 < factor
+}
+
+func (pool *ServerPool) warmingUp(servers []*serverutil.Server) bool {
+	for _, server := range servers {
+		if pool.SlowStartFactor(server) < 1 {
+			return true
+		}
+	}
+	return false
+}
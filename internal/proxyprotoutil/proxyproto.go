@@ -0,0 +1,349 @@
+package proxyprotoutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//V1 ...
+	V1 = "v1"
+	//V2 ...
+	V2 = "v2"
+
+	defaultHeaderTimeout = 5 * time.Second
+	//Longest v1 header including CRLF
+	maxV1HeaderSize = 107
+)
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//ErrMalformedHeader ...
+var ErrMalformedHeader = errors.New("malformed PROXY protocol header")
+
+var trusted []*net.IPNet
+var trustedMux sync.RWMutex
+
+//SetTrusted replaces the sources allowed to send the header. No sources turns the parsing off.
+func SetTrusted(nets []*net.IPNet) {
+	trustedMux.Lock()
+	defer trustedMux.Unlock()
+	trusted = nets
+}
+
+//Trusted reports whether the header is accepted from the address
+func Trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	trustedMux.RLock()
+	defer trustedMux.RUnlock()
+	for _, ipNet := range trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//Valid reports whether the version is known, empty one turns the header off
+func Valid(version string) bool {
+	switch version {
+	case "", V1, V2:
+		return true
+	}
+	return false
+}
+
+//Listener reads the header from the connections of the trusted sources. Their remote and
+//local addresses are replaced with the ones from the header, so everything down the line
+//sees the real client.
+type Listener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+//NewListener ...
+func NewListener(listener net.Listener, timeout time.Duration) *Listener {
+	if timeout <= 0 {
+		timeout = defaultHeaderTimeout
+	}
+	return &Listener{Listener: listener, timeout: timeout}
+}
+
+//Accept ...
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !Trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+//Conn parses the header lazily, so a slow client doesn't hold the accept loop up.
+//Header is optional, connections without it are passed as is.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	remote  net.Addr
+	local   net.Addr
+	err     error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout)) //nolint
+		c.remote, c.local, c.err = readHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{}) //nolint
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+//RemoteAddr ...
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+//LocalAddr ...
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func readHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		//Nothing's sent yet, the connection gets its own read errors later on
+		return nil, nil, nil
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		if prefix, err := reader.Peek(len(v1Prefix)); err == nil && bytes.Equal(prefix, v1Prefix) {
+			return readV1(reader)
+		}
+	case v2Signature[0]:
+		if signature, err := reader.Peek(len(v2Signature)); err == nil && bytes.Equal(signature, v2Signature) {
+			return readV2(reader)
+		}
+	}
+	return nil, nil, nil
+}
+
+func readV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderSize {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrMalformedHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrMalformedHeader
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	//Both addresses must be of the declared family
+	ipv6 := fields[1] == "TCP6"
+	if strings.Contains(fields[2], ":") != ipv6 || strings.Contains(fields[3], ":") != ipv6 {
+		return nil, nil, ErrMalformedHeader
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(host string, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil, ErrMalformedHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, ErrMalformedHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	//LOCAL command comes from the proxy itself, e.g. from its health checks
+	switch header[12] & 0x0f {
+	case 0:
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, ErrMalformedHeader
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		//Unix sockets and unspecified families keep the real addresses
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrMalformedHeader
+	}
+
+	src := &net.TCPAddr{IP: net.IP(payload[:ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen:]))}
+	dst := &net.TCPAddr{IP: net.IP(payload[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))}
+	return src, dst, nil
+}
+
+//WriteHeader writes the header of the given version. Unknown addresses produce
+//v1 UNKNOWN or v2 LOCAL header, so the receiver keeps the connection's own addresses.
+func WriteHeader(w io.Writer, version string, src net.Addr, dst net.Addr) error {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && srcAddr != nil && dstAddr != nil
+	//Both addresses must be of the same family
+	if known && (srcAddr.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		known = false
+	}
+
+	var header []byte
+	switch version {
+	case V1:
+		if !known {
+			header = []byte("PROXY UNKNOWN\r\n")
+			break
+		}
+		family := "TCP4"
+		if srcAddr.IP.To4() == nil {
+			family = "TCP6"
+		}
+		header = []byte(fmt.Sprintf("PROXY %s %s %s %v %v\r\n", family, srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port))
+
+	case V2:
+		header = append(header, v2Signature...)
+		if !known {
+			header = append(header, 0x20, 0x00, 0x00, 0x00)
+			break
+		}
+
+		srcIP, dstIP, family := srcAddr.IP.To4(), dstAddr.IP.To4(), byte(0x11)
+		if srcIP == nil {
+			srcIP, dstIP, family = srcAddr.IP.To16(), dstAddr.IP.To16(), 0x21
+		}
+		header = append(header, 0x21, family, 0, 0)
+		binary.BigEndian.PutUint16(header[14:], uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		header = append(header, byte(srcAddr.Port>>8), byte(srcAddr.Port), byte(dstAddr.Port>>8), byte(dstAddr.Port))
+
+	default:
+		return nil
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+//ParseAddr ...
+func ParseAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	tcpAddr, err := parseV1Addr(host, port)
+	if err != nil {
+		return nil
+	}
+	return tcpAddr
+}
+
+type headerKey struct{}
+
+type header struct {
+	version string
+	src     net.Addr
+	dst     net.Addr
+}
+
+//WithHeader makes the connections dialed with the context start with the header
+func WithHeader(ctx context.Context, version string, src net.Addr, dst net.Addr) context.Context {
+	return context.WithValue(ctx, headerKey{}, &header{version: version, src: src, dst: dst})
+}
+
+//Dialer wraps the dial function, so the header from the context is written first on every new connection
+func Dialer(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		h, ok := ctx.Value(headerKey{}).(*header)
+		if !ok {
+			return conn, nil
+		}
+		if err := WriteHeader(conn, h.version, h.src, h.dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
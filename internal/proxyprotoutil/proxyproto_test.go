@@ -0,0 +1,232 @@
+package proxyprotoutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const payload = "GET / HTTP/1.1\r\n\r\n"
+
+func tcpAddr(addr string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+//v2Header builds the header by hand, so the reader is checked against the spec and not only against WriteHeader
+func v2Header(command byte, family byte, body []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		dst  string
+	}{
+		{name: "ipv4", src: "192.168.1.10:51234", dst: "10.0.0.1:443"},
+		{name: "ipv6", src: "[2001:db8::1]:51234", dst: "[2001:db8::2]:8080"},
+		{name: "zero ports", src: "127.0.0.1:0", dst: "127.0.0.1:0"},
+		{name: "max ports", src: "[::1]:65535", dst: "[::1]:65535"},
+	}
+
+	for _, version := range []string{V1, V2} {
+		for _, tt := range tests {
+			t.Run(version+" "+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteHeader(&buf, version, tcpAddr(tt.src), tcpAddr(tt.dst)); err != nil {
+					t.Fatal(err)
+				}
+				buf.WriteString(payload)
+
+				reader := bufio.NewReader(&buf)
+				src, dst, err := readHeader(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if src == nil || src.String() != tcpAddr(tt.src).String() {
+					t.Errorf("got source %v, want %v", src, tt.src)
+				}
+				if dst == nil || dst.String() != tcpAddr(tt.dst).String() {
+					t.Errorf("got destination %v, want %v", dst, tt.dst)
+				}
+
+				rest, _ := io.ReadAll(reader)
+				if string(rest) != payload {
+					t.Errorf("got %q after the header, want %q", rest, payload)
+				}
+			})
+		}
+	}
+}
+
+func TestUnknownAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+	}{
+		{name: "no addresses"},
+		{name: "no destination", src: tcpAddr("1.2.3.4:80")},
+		{name: "mixed families", src: tcpAddr("1.2.3.4:80"), dst: tcpAddr("[::1]:80")},
+		{name: "not tcp", src: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4)}, dst: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4)}},
+	}
+
+	for _, version := range []string{V1, V2} {
+		for _, tt := range tests {
+			t.Run(version+" "+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteHeader(&buf, version, tt.src, tt.dst); err != nil {
+					t.Fatal(err)
+				}
+				if version == V1 && buf.String() != "PROXY UNKNOWN\r\n" {
+					t.Fatalf("got %q, want UNKNOWN header", buf.String())
+				}
+				buf.WriteString(payload)
+
+				reader := bufio.NewReader(&buf)
+				src, dst, err := readHeader(reader)
+				if err != nil || src != nil || dst != nil {
+					t.Fatalf("got %v, %v, %v, want connection's own addresses kept", src, dst, err)
+				}
+				if rest, _ := io.ReadAll(reader); string(rest) != payload {
+					t.Errorf("got %q after the header, want %q", rest, payload)
+				}
+			})
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := append(append([]byte{192, 168, 0, 1, 10, 0, 0, 1}, 0x1f, 0x90), 0x01, 0xbb)
+	ipv6 := append(append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0x1f, 0x90, 0x01, 0xbb)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		src     string
+		dst     string
+		err     error
+		anyErr  bool
+		payload bool
+	}{
+		{name: "no header", input: []byte(payload), payload: true},
+		{name: "empty connection", input: nil},
+		{name: "v1", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 8080 443\r\n" + payload), src: "192.168.0.1:8080", dst: "10.0.0.1:443", payload: true},
+		{name: "v1 ipv6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 8080 443\r\n" + payload), src: "[2001:db8::1]:8080", dst: "[2001:db8::2]:443", payload: true},
+		{name: "v1 unknown with addresses", input: []byte("PROXY UNKNOWN 1.1.1.1 2.2.2.2 1 2\r\n" + payload), payload: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.168.0.1 10.0"), anyErr: true},
+		{name: "v1 without CR", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 8080 443\n"), err: ErrMalformedHeader},
+		{name: "v1 oversized", input: []byte("PROXY TCP6 " + strings.Repeat("f", maxV1HeaderSize) + "\r\n"), err: ErrMalformedHeader},
+		{name: "v1 missing field", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 8080\r\n"), err: ErrMalformedHeader},
+		{name: "v1 unknown family", input: []byte("PROXY UDP4 192.168.0.1 10.0.0.1 8080 443\r\n"), err: ErrMalformedHeader},
+		{name: "v1 malformed address", input: []byte("PROXY TCP4 192.168.0.300 10.0.0.1 8080 443\r\n"), err: ErrMalformedHeader},
+		{name: "v1 port out of range", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 65536 443\r\n"), err: ErrMalformedHeader},
+		{name: "v1 ipv6 address in TCP4", input: []byte("PROXY TCP4 2001:db8::1 10.0.0.1 8080 443\r\n"), err: ErrMalformedHeader},
+		{name: "v1 ipv4 address in TCP6", input: []byte("PROXY TCP6 2001:db8::1 10.0.0.1 8080 443\r\n"), err: ErrMalformedHeader},
+		{name: "v2 ipv4", input: append(v2Header(1, 0x11, ipv4), payload...), src: "192.168.0.1:8080", dst: "10.0.0.1:443", payload: true},
+		{name: "v2 ipv6", input: append(v2Header(1, 0x21, ipv6), payload...), src: "[2001:db8::1]:8080", dst: "[2001:db8::2]:443", payload: true},
+		{name: "v2 with TLVs", input: append(v2Header(1, 0x11, append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0xff)), payload...), src: "192.168.0.1:8080", dst: "10.0.0.1:443", payload: true},
+		{name: "v2 local", input: append(v2Header(0, 0x11, ipv4), payload...), payload: true},
+		{name: "v2 unspecified family", input: append(v2Header(1, 0x00, nil), payload...), payload: true},
+		{name: "v2 unix family", input: append(v2Header(1, 0x31, make([]byte, 216)), payload...), payload: true},
+		{name: "v2 truncated header", input: append([]byte{}, v2Signature...), anyErr: true},
+		{name: "v2 truncated payload", input: v2Header(1, 0x11, ipv4)[:20], anyErr: true},
+		{name: "v2 payload too short for family", input: v2Header(1, 0x21, ipv4), err: ErrMalformedHeader},
+		{name: "v2 wrong version", input: append(append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 12), ipv4...), err: ErrMalformedHeader},
+		{name: "v2 unknown command", input: v2Header(2, 0x11, ipv4), err: ErrMalformedHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(tt.input))
+			src, dst, err := readHeader(reader)
+
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			case tt.anyErr:
+				if err == nil {
+					t.Fatal("got no error for truncated header")
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			if got := addrString(src); got != tt.src {
+				t.Errorf("got source %q, want %q", got, tt.src)
+			}
+			if got := addrString(dst); got != tt.dst {
+				t.Errorf("got destination %q, want %q", got, tt.dst)
+			}
+			if rest, _ := io.ReadAll(reader); tt.payload && string(rest) != payload {
+				t.Errorf("got %q after the header, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: time.Second}
+	defer conn.Close()
+
+	go func() {
+		WriteHeader(client, V2, tcpAddr("192.168.0.1:8080"), tcpAddr("10.0.0.1:443")) //nolint
+		client.Write([]byte(payload))                                                 //nolint
+	}()
+
+	if got := conn.RemoteAddr().String(); got != "192.168.0.1:8080" {
+		t.Errorf("got remote address %v, want the one from the header", got)
+	}
+	if got := conn.LocalAddr().String(); got != "10.0.0.1:443" {
+		t.Errorf("got local address %v, want the one from the header", got)
+	}
+
+	buf := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != payload {
+		t.Errorf("got %q, %v, want %q", buf, err, payload)
+	}
+}
+
+func TestConnMalformed(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: time.Second}
+	defer conn.Close()
+
+	go client.Write([]byte("PROXY TCP4 garbage\r\n" + payload)) //nolint
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrMalformedHeader) {
+		t.Errorf("got %v, want %v", err, ErrMalformedHeader)
+	}
+	if got := conn.RemoteAddr(); got != server.RemoteAddr() {
+		t.Errorf("got remote address %v, want the connection's own one", got)
+	}
+}
@@ -3,24 +3,37 @@ package proxyutil
 import (
 	"balansir/internal/cacheutil"
 	"balansir/internal/configutil"
+	"balansir/internal/forwardutil"
 	"balansir/internal/gziputil"
 	"balansir/internal/logutil"
 	"balansir/internal/statusutil"
+	"balansir/internal/tunnelutil"
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"time"
 )
 
 //ModifyResponse ...
 func ModifyResponse(r *http.Response) error {
+	//Shadow responses are discarded, so they're neither counted nor cached
+	if r.Request.Header.Get("X-Balansir-Mirror") != "" {
+		return nil
+	}
+
 	//TODO move this to httptrace.ClientTrace in dispatchutil
 	statusCodes := statusutil.GetStatusCodes()
 	statusCodes.HitStatus(r.StatusCode)
 
 	configuration := configutil.GetConfig()
 
+	//Streams are passed through as is, so every chunk reaches the client right away
+	if tunnelutil.IsStreaming(r) {
+		return nil
+	}
+
 	//Check if response must be gzipped
 	if configuration.GzipResponse {
 		if gziputil.Allow(r.Header.Get("Content-Type")) {
@@ -32,60 +45,90 @@ func ModifyResponse(r *http.Response) error {
 		return nil
 	}
 
-	mustBeCached, TTL := cacheutil.ContainsRule(r.Request.URL.Path, configuration.Cache.Rules)
-	if !mustBeCached {
+	rule := cacheutil.GetRule(r.Request.URL.Path, configuration.Cache.Rules)
+	if rule == nil {
 		return nil
 	}
 
 	trackMiss := r.Request.Header.Get("X-Balansir-Background-Update") == ""
 	cache := cacheutil.GetCluster()
+	key := cacheutil.Key(r.Request)
 
-	_, err := cache.Get(r.Request.URL.Path, trackMiss)
-	//err == nil means that response for a given key is already cached
-	if err == nil {
-		return nil
-	}
-
-	hashedKey := cache.Hash.Sum(r.Request.URL.Path)
+	//Requests waiting for the response are released even if it isn't stored
+	hashedKey := cache.Hash.Sum(key)
 	defer cache.Queue.Release(hashedKey)
 
-	headersBuf := bytes.NewBuffer([]byte{})
+	//Answers to conditional and range requests are incomplete
+	if r.StatusCode == http.StatusNotModified || r.StatusCode == http.StatusPartialContent {
+		return nil
+	}
 
-	for key, val := range r.Header {
-		headersBuf.Write([]byte(key))
-		//Add delimeter so we can split header's key and value later on
-		headersBuf.Write(cacheutil.KeyValueDelimeter)
+	//Surrogate keys are meant for the cache only
+	tags := cacheutil.SurrogateKeys(r.Header)
+	r.Header.Del("Surrogate-Key")
+	r.Header.Del("Cache-Tag")
+
+	TTL := rule.TTL
+	var age time.Duration
+	if configuration.Cache.Mode == cacheutil.RFCMode {
+		var ok bool
+		TTL, age, ok = cacheutil.Storable(r, rule)
+		if !ok {
+			return nil
+		}
 
-		headerValueBuf := bytes.NewBuffer([]byte{})
-		//Header value is a string slice
-		headerValueBuf.Write([]byte(strings.Join(val, "")))
+		vary := cacheutil.VaryHeaders(r.Header)
+		cache.SetVary(key, vary)
+		key = cacheutil.VariantKey(key, vary, r.Request)
+	}
 
-		headersBuf.Write(headerValueBuf.Bytes())
-		//Add delimeter so we can split pairs out of each other later on
-		headersBuf.Write(cacheutil.PairDelimeter)
+	_, err := cache.Get(key, trackMiss)
+	//err == nil means that response for a given key is already cached
+	if err == nil {
+		return nil
 	}
 
-	//Add delimeter so we can split headers from body later on
-	headersBuf.Write(cacheutil.HeadersDelimeter)
+	//Server error doesn't replace the stale response, which is served instead within its stale-if-error window
+	if r.StatusCode >= http.StatusInternalServerError {
+		if _, _, err := cache.GetStale(key); err == nil {
+			return nil
+		}
+	}
 
 	b, _ := ioutil.ReadAll(r.Body)
-	bodyBuf := bytes.NewBuffer(b)
-
 	//Reassign and close response body with no-op
-	r.Body = ioutil.NopCloser(bodyBuf)
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
 
-	responseBuf := bytes.NewBuffer([]byte{})
-	responseBuf.Write(headersBuf.Bytes())
-	responseBuf.Write(bodyBuf.Bytes())
+	//Validators go to the client as well, so it can revalidate against the cache
+	cacheutil.SetValidators(r.Header, b)
 
-	err = cache.Set(r.Request.URL.Path, responseBuf.Bytes(), TTL)
+	//Age of the cached response is counted from the moment it was created at the origin
+	entry := cacheutil.NewEntry(r.StatusCode, r.Header, b, time.Now().Add(-age).Unix(), TTL)
+	entry.StaleWhileRevalidate, entry.StaleIfError = cacheutil.StaleWindows(r, rule, configuration.Cache.Mode == cacheutil.RFCMode)
+
+	err = cache.Set(key, entry.Encode(), TTL, entry.Grace())
 	if err != nil {
 		logutil.Warning(err)
+		return nil
 	}
+	cache.SetTags(key, tags)
 
 	return nil
 }
 
+type attemptKey struct{}
+
+//Attempt ...
+type Attempt struct {
+	Err error
+}
+
+//WithAttempt ...
+func WithAttempt(r *http.Request) (*http.Request, *Attempt) {
+	attempt := &Attempt{}
+	return r.WithContext(context.WithValue(r.Context(), attemptKey{}, attempt)), attempt
+}
+
 //ErrorHandler ...
 func ErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
 	if err != nil {
@@ -95,7 +138,15 @@ func ErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
 		// just junk the log around.
 		if err.Error() == "context canceled" {
 		} else {
-			logutil.Error(fmt.Sprintf(`proxy error: %s`, err.Error()))
+			logutil.Error(fmt.Sprintf(`proxy error for %s: %s`, forwardutil.ClientIP(r), err.Error()))
 		}
 	}
+
+	// Leave the response to the dispatcher if it tracks the attempt,
+	// so the request can be retried on another server.
+	if attempt, ok := r.Context().Value(attemptKey{}).(*Attempt); ok {
+		attempt.Err = err
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
 }
@@ -0,0 +1,40 @@
+package routeutil
+
+import (
+	"balansir/internal/configutil"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultHedgeBudgetPercent = 10
+	defaultHedgeMinPerSecond  = 1
+)
+
+//Hedge sends a second copy of a slow request to another server. Zero delay means
+//the pool's observed 95th percentile of response time is used instead.
+type Hedge struct {
+	Delay         time.Duration
+	BudgetPercent int
+	MinPerSecond  int
+}
+
+func newHedge(routeName string, hedge *configutil.Hedge) (*Hedge, error) {
+	if hedge.Delay < 0 {
+		return nil, fmt.Errorf(`negative hedge delay (%v) is specified for (%s) route in config["routes"]`, hedge.Delay, routeName)
+	}
+
+	compiled := &Hedge{
+		Delay:         time.Duration(hedge.Delay) * time.Millisecond,
+		BudgetPercent: hedge.BudgetPercent,
+		MinPerSecond:  hedge.MinPerSecond,
+	}
+	if compiled.BudgetPercent <= 0 {
+		compiled.BudgetPercent = defaultHedgeBudgetPercent
+	}
+	if compiled.MinPerSecond <= 0 {
+		compiled.MinPerSecond = defaultHedgeMinPerSecond
+	}
+
+	return compiled, nil
+}
@@ -0,0 +1,55 @@
+package routeutil
+
+import (
+	"balansir/internal/configutil"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	defaultMirrorBodySize   = 64 * 1024
+	defaultMirrorConcurrent = 100
+)
+
+//Mirror copies a share of the route traffic to a shadow upstream
+type Mirror struct {
+	Upstream      string
+	Percent       float64
+	MaxBodySize   int64
+	MaxConcurrent int64
+	Primary       *TrafficStats
+	Shadow        *TrafficStats
+}
+
+func newMirror(routeName string, mirror *configutil.Mirror, upstreams map[string]bool, stats *statsRegistry) (*Mirror, error) {
+	if !upstreams[mirror.Upstream] {
+		return nil, fmt.Errorf(`unknown upstream (%s) is specified in mirror for (%s) route in config["routes"]`, mirror.Upstream, routeName)
+	}
+	if mirror.Percent < 0 || mirror.Percent > 100 {
+		return nil, fmt.Errorf(`mirror percent (%v) for (%s) route in config["routes"] must be between 0 and 100`, mirror.Percent, routeName)
+	}
+
+	compiled := &Mirror{
+		Upstream:      mirror.Upstream,
+		Percent:       mirror.Percent,
+		MaxBodySize:   mirror.MaxBodySize,
+		MaxConcurrent: mirror.MaxConcurrent,
+	}
+	if compiled.MaxBodySize <= 0 {
+		compiled.MaxBodySize = defaultMirrorBodySize
+	}
+	if compiled.MaxConcurrent <= 0 {
+		compiled.MaxConcurrent = defaultMirrorConcurrent
+	}
+
+	//Primary stats only count the mirrored requests, so both sides are compared on the same traffic
+	compiled.Primary = stats.get(routeName + "/mirror/primary")
+	compiled.Shadow = stats.get(routeName + "/mirror/" + mirror.Upstream)
+
+	return compiled, nil
+}
+
+//Sample decides whether the request must be mirrored
+func (m *Mirror) Sample() bool {
+	return m.Percent >= 100 || rand.Float64()*100 < m.Percent
+}
@@ -0,0 +1,192 @@
+package routeutil
+
+import (
+	"balansir/internal/configutil"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//Route ...
+type Route struct {
+	Name       string
+	Upstream   string
+	Split      *Split
+	Mirror     *Mirror
+	Hedge      *Hedge
+	host       string
+	wildcard   bool
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	methods    map[string]bool
+	headers    map[string]string
+}
+
+//Table is an ordered list of routes, the first matching route wins
+type Table struct {
+	routes []*Route
+	stats  map[string]*TrafficStats
+}
+
+var table *Table
+var mux sync.RWMutex
+
+//GetTable ...
+func GetTable() *Table {
+	mux.RLock()
+	defer mux.RUnlock()
+	return table
+}
+
+//SetTable ...
+func SetTable(newTable *Table) {
+	mux.Lock()
+	defer mux.Unlock()
+	table = newTable
+}
+
+//NewTable compiles configured routes. Every route must point to one of the known upstreams.
+func NewTable(routes []*configutil.Route, upstreams map[string]bool) (*Table, error) {
+	//Counters survive reloads as long as the route and upstream stay the same
+	stats := &statsRegistry{current: make(map[string]*TrafficStats)}
+	if oldTable := GetTable(); oldTable != nil {
+		stats.previous = oldTable.stats
+	}
+
+	newTable := &Table{stats: stats.current}
+	for i, route := range routes {
+		name := route.Name
+		if name == "" {
+			name = fmt.Sprintf("#%v", i)
+		}
+
+		if route.Upstream == "" && route.Split == nil {
+			return nil, fmt.Errorf(`neither upstream nor split is specified for (%s) route in config["routes"]`, name)
+		}
+		if route.Upstream != "" && !upstreams[route.Upstream] {
+			return nil, fmt.Errorf(`unknown upstream (%s) is specified for (%s) route in config["routes"]`, route.Upstream, name)
+		}
+
+		compiled := &Route{
+			Name:       name,
+			Upstream:   route.Upstream,
+			host:       strings.ToLower(route.Host),
+			pathPrefix: route.PathPrefix,
+			headers:    route.Headers,
+		}
+
+		if route.Split != nil {
+			split, err := newSplit(name, route.Split, upstreams, stats)
+			if err != nil {
+				return nil, err
+			}
+			compiled.Split = split
+		}
+
+		if route.Mirror != nil {
+			mirror, err := newMirror(name, route.Mirror, upstreams, stats)
+			if err != nil {
+				return nil, err
+			}
+			compiled.Mirror = mirror
+		}
+
+		if route.Hedge != nil {
+			hedge, err := newHedge(name, route.Hedge)
+			if err != nil {
+				return nil, err
+			}
+			compiled.Hedge = hedge
+		}
+
+		if strings.HasPrefix(compiled.host, "*.") {
+			compiled.wildcard = true
+			compiled.host = compiled.host[1:]
+		}
+
+		if route.PathRegex != "" {
+			re, err := regexp.Compile(route.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf(`malformed path_regex for (%s) route in config["routes"]: %w`, name, err)
+			}
+			compiled.pathRegex = re
+		}
+
+		if len(route.Methods) > 0 {
+			compiled.methods = make(map[string]bool)
+			for _, method := range route.Methods {
+				compiled.methods[strings.ToUpper(method)] = true
+			}
+		}
+
+		newTable.routes = append(newTable.routes, compiled)
+	}
+
+	return newTable, nil
+}
+
+//Routes ...
+func (t *Table) Routes() []*Route {
+	if t == nil {
+		return nil
+	}
+	return t.routes
+}
+
+//Match returns the first route matching the request or nil
+func (t *Table) Match(r *http.Request) *Route {
+	if t == nil {
+		return nil
+	}
+
+	for _, route := range t.routes {
+		if route.match(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (route *Route) match(r *http.Request) bool {
+	if route.host != "" {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if route.wildcard {
+			if !strings.HasSuffix(host, route.host) {
+				return false
+			}
+		} else if host != route.host {
+			return false
+		}
+	}
+
+	if route.pathPrefix != "" && !strings.HasPrefix(r.URL.Path, route.pathPrefix) {
+		return false
+	}
+
+	if route.pathRegex != nil && !route.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+
+	if route.methods != nil && !route.methods[r.Method] {
+		return false
+	}
+
+	//Empty header value only requires the header to be present
+	for key, val := range route.headers {
+		if _, ok := r.Header[http.CanonicalHeaderKey(key)]; !ok {
+			return false
+		}
+		if val != "" && r.Header.Get(key) != val {
+			return false
+		}
+	}
+
+	return true
+}
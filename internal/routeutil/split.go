@@ -0,0 +1,159 @@
+package routeutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/forwardutil"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+const (
+	splitKeyIP     = "ip"
+	splitKeyHeader = "header"
+	splitKeyCookie = "cookie"
+
+	variantCookiePrefix = "X-Balansir-Variant-"
+)
+
+//Split divides route traffic between upstreams proportionally to the variants weights
+type Split struct {
+	variants       []*Variant
+	total          int
+	key            string
+	name           string
+	overrideHeader string
+	overrideCookie string
+	cookie         string
+	cookieMaxAge   int
+}
+
+//Variant ...
+type Variant struct {
+	Upstream string
+	Weight   int
+	Stats    *TrafficStats
+}
+
+func newSplit(routeName string, split *configutil.Split, upstreams map[string]bool, stats *statsRegistry) (*Split, error) {
+	compiled := &Split{
+		key:            split.Key,
+		name:           split.Name,
+		overrideHeader: split.OverrideHeader,
+		overrideCookie: split.OverrideCookie,
+		cookie:         variantCookiePrefix + fmt.Sprintf("%08x", hash(routeName)),
+		cookieMaxAge:   split.CookieMaxAge,
+	}
+
+	switch compiled.key {
+	case "":
+		compiled.key = splitKeyIP
+	case splitKeyIP, splitKeyHeader, splitKeyCookie:
+	default:
+		return nil, fmt.Errorf(`unknown split key (%s) for (%s) route in config["routes"]. Use one of the following: ip, header, cookie`, split.Key, routeName)
+	}
+
+	for _, variant := range split.Variants {
+		if !upstreams[variant.Upstream] {
+			return nil, fmt.Errorf(`unknown upstream (%s) is specified in split for (%s) route in config["routes"]`, variant.Upstream, routeName)
+		}
+		if variant.Weight < 0 {
+			return nil, fmt.Errorf(`negative weight (%v) is specified for (%s) variant of (%s) route in config["routes"]`, variant.Weight, variant.Upstream, routeName)
+		}
+
+		compiled.variants = append(compiled.variants, &Variant{
+			Upstream: variant.Upstream,
+			Weight:   variant.Weight,
+			Stats:    stats.get(routeName + "/" + variant.Upstream),
+		})
+		compiled.total += variant.Weight
+	}
+
+	if compiled.total <= 0 {
+		return nil, fmt.Errorf(`split for (%s) route in config["routes"] must have at least one variant with non-zero weight`, routeName)
+	}
+
+	return compiled, nil
+}
+
+//Variants ...
+func (s *Split) Variants() []*Variant {
+	return s.variants
+}
+
+//Choose picks a variant for the request. Forced variants go first, then the one the client
+//was already assigned to, so changing the weights doesn't move assigned clients around.
+//The second value reports whether the assignment is new.
+func (s *Split) Choose(r *http.Request) (*Variant, bool) {
+	if s.overrideHeader != "" {
+		if variant := s.find(r.Header.Get(s.overrideHeader)); variant != nil {
+			return variant, false
+		}
+	}
+	if s.overrideCookie != "" {
+		if cookie, err := r.Cookie(s.overrideCookie); err == nil {
+			if variant := s.find(cookie.Value); variant != nil {
+				return variant, false
+			}
+		}
+	}
+
+	if cookie, err := r.Cookie(s.cookie); err == nil {
+		if variant := s.find(cookie.Value); variant != nil && variant.Weight > 0 {
+			return variant, false
+		}
+	}
+
+	point := int(hash(s.getKey(r)) % uint32(s.total))
+	for _, variant := range s.variants {
+		if point < variant.Weight {
+			return variant, true
+		}
+		point -= variant.Weight
+	}
+
+	return s.variants[len(s.variants)-1], true
+}
+
+func (s *Split) find(upstream string) *Variant {
+	if upstream == "" {
+		return nil
+	}
+	for _, variant := range s.variants {
+		if variant.Upstream == upstream {
+			return variant
+		}
+	}
+	return nil
+}
+
+func (s *Split) getKey(r *http.Request) string {
+	switch s.key {
+	case splitKeyHeader:
+		if val := r.Header.Get(s.name); val != "" {
+			return val
+		}
+	case splitKeyCookie:
+		if cookie, err := r.Cookie(s.name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+
+	return forwardutil.ClientIP(r)
+}
+
+//Track wraps the response writer to count the variant's statuses and response time.
+//The returned function must be called once the request is served.
+func (s *Split) Track(w http.ResponseWriter, variant *Variant, assigned bool) (http.ResponseWriter, func()) {
+	var cookie *http.Cookie
+	if assigned {
+		cookie = &http.Cookie{Name: s.cookie, Value: variant.Upstream, Path: "/", MaxAge: s.cookieMaxAge}
+	}
+	return Track(w, variant.Stats, cookie)
+}
+
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key)) //nolint
+	return h.Sum32()
+}
@@ -0,0 +1,132 @@
+package routeutil
+
+import (
+	"balansir/internal/statusutil"
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+//TrafficStats are kept between config reloads for the same route and upstream
+type TrafficStats struct {
+	StatusCodes  *statusutil.StatusCodes
+	requests     int64
+	responseTime int64
+	inFlight     int64
+	dropped      int64
+}
+
+//NewTrafficStats ...
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{StatusCodes: statusutil.NewStatusCodes()}
+}
+
+//Stats of the previous table are picked up by the new one for the same keys
+type statsRegistry struct {
+	previous map[string]*TrafficStats
+	current  map[string]*TrafficStats
+}
+
+func (sr *statsRegistry) get(key string) *TrafficStats {
+	stats, ok := sr.previous[key]
+	if !ok {
+		stats = NewTrafficStats()
+	}
+	sr.current[key] = stats
+	return stats
+}
+
+//Record ...
+func (ts *TrafficStats) Record(status int, responseTime time.Duration) {
+	atomic.AddInt64(&ts.requests, 1)
+	atomic.AddInt64(&ts.responseTime, int64(responseTime))
+	if status != 0 {
+		ts.StatusCodes.HitStatus(status)
+	}
+}
+
+//TryStart counts the request in flight, unless there are as many as the limit already.
+//Requests over the limit are counted as dropped.
+func (ts *TrafficStats) TryStart(limit int64) bool {
+	if atomic.AddInt64(&ts.inFlight, 1) > limit {
+		atomic.AddInt64(&ts.inFlight, -1)
+		atomic.AddInt64(&ts.dropped, 1)
+		return false
+	}
+	return true
+}
+
+//Done ...
+func (ts *TrafficStats) Done() {
+	atomic.AddInt64(&ts.inFlight, -1)
+}
+
+//GetDropped ...
+func (ts *TrafficStats) GetDropped() int64 {
+	return atomic.LoadInt64(&ts.dropped)
+}
+
+//GetRequests ...
+func (ts *TrafficStats) GetRequests() int64 {
+	return atomic.LoadInt64(&ts.requests)
+}
+
+//GetAverageResponseTime ...
+func (ts *TrafficStats) GetAverageResponseTime() time.Duration {
+	requests := atomic.LoadInt64(&ts.requests)
+	if requests == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&ts.responseTime) / requests)
+}
+
+//Track wraps the response writer to count statuses and response time. If cookie is given,
+//it's set along with the response headers. The returned function must be called once the request is served.
+func Track(w http.ResponseWriter, stats *TrafficStats, cookie *http.Cookie) (http.ResponseWriter, func()) {
+	tw := &trackingWriter{ResponseWriter: w, cookie: cookie}
+	start := time.Now()
+	return tw, func() {
+		stats.Record(tw.status, time.Since(start))
+	}
+}
+
+//Cookie is set right before the headers are sent, so it survives
+//the headers reset between retries
+type trackingWriter struct {
+	http.ResponseWriter
+	cookie *http.Cookie
+	status int
+}
+
+func (tw *trackingWriter) WriteHeader(status int) {
+	if tw.status == 0 {
+		tw.status = status
+		if tw.cookie != nil {
+			http.SetCookie(tw.ResponseWriter, tw.cookie)
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *trackingWriter) Write(b []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+//Hijack counts the connection switched to another protocol
+func (tw *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(tw.ResponseWriter).Hijack()
+	if err == nil && tw.status == 0 {
+		tw.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+//Unwrap lets http.ResponseController reach the underlying writer
+func (tw *trackingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,272 @@
+package serverutil
+
+import (
+	"balansir/internal/configutil"
+	"sync"
+	"time"
+)
+
+const (
+	//BreakerClosed ...
+	BreakerClosed = "closed"
+	//BreakerOpen ...
+	BreakerOpen = "open"
+	//BreakerHalfOpen ...
+	BreakerHalfOpen = "half-open"
+)
+
+const (
+	defaultBreakerWindow      = 10
+	defaultBreakerMinRequests = 20
+	defaultBreakerErrorRate   = 50
+	defaultBreakerSlowRate    = 50
+	defaultBreakerOpenTimeout = 30
+	defaultHalfOpenRequests   = 3
+)
+
+type breakerBucket struct {
+	timestamp int64
+	requests  int
+	failures  int
+	slow      int
+}
+
+//BreakerSettings ...
+type BreakerSettings struct {
+	Enabled          bool
+	Window           int
+	MinRequests      int
+	ErrorRate        int
+	LatencyThreshold time.Duration
+	SlowRate         int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+//GetBreakerSettings ...
+func GetBreakerSettings(circuitBreaker *configutil.CircuitBreaker) BreakerSettings {
+	settings := BreakerSettings{
+		Enabled:          circuitBreaker.Enabled,
+		Window:           circuitBreaker.Window,
+		MinRequests:      circuitBreaker.MinRequests,
+		ErrorRate:        circuitBreaker.ErrorRate,
+		LatencyThreshold: time.Duration(circuitBreaker.LatencyThreshold) * time.Millisecond,
+		SlowRate:         circuitBreaker.SlowRate,
+		OpenTimeout:      time.Duration(circuitBreaker.OpenTimeout) * time.Second,
+		HalfOpenRequests: circuitBreaker.HalfOpenRequests,
+	}
+
+	if settings.Window <= 0 {
+		settings.Window = defaultBreakerWindow
+	}
+	if settings.MinRequests <= 0 {
+		settings.MinRequests = defaultBreakerMinRequests
+	}
+	if settings.ErrorRate <= 0 {
+		settings.ErrorRate = defaultBreakerErrorRate
+	}
+	if settings.SlowRate <= 0 {
+		settings.SlowRate = defaultBreakerSlowRate
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = defaultBreakerOpenTimeout * time.Second
+	}
+	if settings.HalfOpenRequests <= 0 {
+		settings.HalfOpenRequests = defaultHalfOpenRequests
+	}
+
+	return settings
+}
+
+//CircuitBreaker ...
+type CircuitBreaker struct {
+	mux              sync.Mutex
+	state            string
+	buckets          []breakerBucket
+	openedAt         time.Time
+	halfOpenAt       time.Time
+	openTimeout      time.Duration
+	halfOpenRequests int
+	trials           int
+	successes        int
+}
+
+//State ...
+func (cb *CircuitBreaker) State() string {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.tryHalfOpen()
+	return cb.getState()
+}
+
+func (cb *CircuitBreaker) getState() string {
+	if cb.state == "" {
+		return BreakerClosed
+	}
+	return cb.state
+}
+
+//Ready reports whether the breaker lets a request through without taking a trial slot
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.tryHalfOpen()
+
+	switch cb.getState() {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return cb.trials < cb.halfOpenRequests
+	}
+	return true
+}
+
+//Allow ...
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	cb.tryHalfOpen()
+
+	switch cb.getState() {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if cb.trials >= cb.halfOpenRequests {
+			return false
+		}
+		cb.trials++
+	}
+	return true
+}
+
+//Record ...
+func (cb *CircuitBreaker) Record(success bool, settings BreakerSettings) (string, bool) {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	switch cb.getState() {
+	case BreakerHalfOpen:
+		if !success {
+			cb.open(settings)
+			return cb.state, true
+		}
+		cb.successes++
+		if cb.successes >= cb.halfOpenRequests {
+			cb.close()
+			return cb.state, true
+		}
+	case BreakerClosed:
+		bucket := cb.bucket(settings.Window)
+		bucket.requests++
+		if !success {
+			bucket.failures++
+		}
+		if cb.exceeded(settings) {
+			cb.open(settings)
+			return cb.state, true
+		}
+	}
+
+	return cb.getState(), false
+}
+
+//RecordLatency ...
+func (cb *CircuitBreaker) RecordLatency(latency time.Duration, settings BreakerSettings) (string, bool) {
+	if settings.LatencyThreshold <= 0 || latency <= settings.LatencyThreshold {
+		return "", false
+	}
+
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+
+	switch cb.getState() {
+	case BreakerHalfOpen:
+		cb.open(settings)
+		return cb.state, true
+	case BreakerClosed:
+		cb.bucket(settings.Window).slow++
+		if cb.exceeded(settings) {
+			cb.open(settings)
+			return cb.state, true
+		}
+	}
+
+	return "", false
+}
+
+//Reset ...
+func (cb *CircuitBreaker) Reset() {
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if cb.getState() != BreakerClosed {
+		cb.close()
+	}
+}
+
+func (cb *CircuitBreaker) bucket(window int) *breakerBucket {
+	if len(cb.buckets) != window {
+		cb.buckets = make([]breakerBucket, window)
+	}
+
+	now := time.Now().Unix()
+	bucket := &cb.buckets[now%int64(window)]
+	if bucket.timestamp != now {
+		*bucket = breakerBucket{timestamp: now}
+	}
+	return bucket
+}
+
+func (cb *CircuitBreaker) exceeded(settings BreakerSettings) bool {
+	var requests, failures, slow int
+	oldest := time.Now().Unix() - int64(settings.Window)
+	for _, bucket := range cb.buckets {
+		if bucket.timestamp > oldest {
+			requests += bucket.requests
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+
+	if requests < settings.MinRequests {
+		return false
+	}
+	if failures*100 >= requests*settings.ErrorRate {
+		return true
+	}
+	return settings.LatencyThreshold > 0 && slow*100 >= requests*settings.SlowRate
+}
+
+func (cb *CircuitBreaker) open(settings BreakerSettings) {
+	cb.state = BreakerOpen
+	cb.openedAt = time.Now()
+	cb.openTimeout = settings.OpenTimeout
+	cb.halfOpenRequests = settings.HalfOpenRequests
+	cb.buckets = nil
+}
+
+func (cb *CircuitBreaker) close() {
+	cb.state = BreakerClosed
+	cb.buckets = nil
+	cb.trials = 0
+	cb.successes = 0
+}
+
+func (cb *CircuitBreaker) tryHalfOpen() {
+	switch cb.getState() {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) >= cb.openTimeout {
+			cb.state = BreakerHalfOpen
+			cb.halfOpenAt = time.Now()
+			cb.trials = 0
+			cb.successes = 0
+		}
+	case BreakerHalfOpen:
+		//Trial requests that never reported back (e.g. cancelled by client)
+		//must not keep the breaker half-open forever
+		if cb.trials >= cb.halfOpenRequests && time.Since(cb.halfOpenAt) >= cb.openTimeout {
+			cb.halfOpenAt = time.Now()
+			cb.trials = 0
+			cb.successes = 0
+		}
+	}
+}
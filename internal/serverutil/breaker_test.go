@@ -0,0 +1,74 @@
+package serverutil
+
+import (
+	"testing"
+	"time"
+)
+
+var testBreakerSettings = BreakerSettings{
+	Enabled:          true,
+	Window:           10,
+	MinRequests:      4,
+	ErrorRate:        50,
+	LatencyThreshold: 100 * time.Millisecond,
+	SlowRate:         50,
+	OpenTimeout:      20 * time.Millisecond,
+	HalfOpenRequests: 2,
+}
+
+var trip = []string{"fail", "fail", "fail", "fail"}
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name   string
+		events [][]string
+		want   string
+		ready  bool
+	}{
+		{name: "closed under min requests", events: [][]string{{"fail", "fail", "fail"}}, want: BreakerClosed, ready: true},
+		{name: "closed under error rate", events: [][]string{{"ok", "ok", "ok", "fail"}}, want: BreakerClosed, ready: true},
+		{name: "opens on error rate", events: [][]string{{"ok", "ok", "fail", "fail"}}, want: BreakerOpen},
+		{name: "opens on slow rate", events: [][]string{{"ok", "ok", "ok", "ok", "slow", "slow"}}, want: BreakerOpen},
+		{name: "half-open after open timeout", events: [][]string{trip, {"wait"}}, want: BreakerHalfOpen, ready: true},
+		{name: "half-open limits trials", events: [][]string{trip, {"wait", "allow", "allow"}}, want: BreakerHalfOpen},
+		{name: "half-open closes on trial successes", events: [][]string{trip, {"wait", "allow", "ok", "allow", "ok"}}, want: BreakerClosed, ready: true},
+		{name: "half-open opens on trial failure", events: [][]string{trip, {"wait", "allow", "ok", "allow", "fail"}}, want: BreakerOpen},
+		{name: "half-open opens on slow trial", events: [][]string{trip, {"wait", "allow", "slow"}}, want: BreakerOpen},
+		{name: "closed window is cleared", events: [][]string{trip, {"wait", "allow", "ok", "allow", "ok", "fail", "fail", "fail"}}, want: BreakerClosed, ready: true},
+		{name: "lost trials are given back", events: [][]string{trip, {"wait", "allow", "allow", "wait"}}, want: BreakerHalfOpen, ready: true},
+		{name: "reset closes", events: [][]string{trip, {"reset"}}, want: BreakerClosed, ready: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := &CircuitBreaker{}
+			for _, events := range tt.events {
+				for _, event := range events {
+					switch event {
+					case "ok":
+						cb.Record(true, testBreakerSettings)
+					case "fail":
+						cb.Record(false, testBreakerSettings)
+					case "slow":
+						cb.RecordLatency(time.Second, testBreakerSettings)
+					case "allow":
+						if !cb.Allow() {
+							t.Fatalf("trial request isn't allowed in %v state", cb.State())
+						}
+					case "wait":
+						time.Sleep(2 * testBreakerSettings.OpenTimeout)
+					case "reset":
+						cb.Reset()
+					}
+				}
+			}
+
+			if got := cb.State(); got != tt.want {
+				t.Errorf("got %v state, want %v", got, tt.want)
+			}
+			if got := cb.Ready(); got != tt.ready {
+				t.Errorf("got ready %v, want %v", got, tt.ready)
+			}
+		})
+	}
+}
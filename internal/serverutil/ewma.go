@@ -0,0 +1,61 @@
+package serverutil
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	//Time window the latency moving average decays over
+	ewmaDecay = 10 * time.Second
+	//Latency assumed for a server without samples while its pool has none either
+	defaultLatency = 100 * time.Millisecond
+)
+
+//EWMA is a peak-sensitive exponentially weighted moving average of response time
+type EWMA struct {
+	mux       sync.Mutex
+	value     float64
+	timestamp time.Time
+}
+
+//Observe ...
+func (e *EWMA) Observe(latency time.Duration) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	now := time.Now()
+	rtt := float64(latency)
+
+	//Latency spikes are taken as is, so a degraded server is penalized immediately,
+	//while recovery is smoothed out over time
+	if rtt > e.value || e.timestamp.IsZero() {
+		e.value = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(e.timestamp)) / float64(ewmaDecay))
+		e.value = e.value*w + rtt*(1-w)
+	}
+	e.timestamp = now
+}
+
+//Value ...
+func (e *EWMA) Value() time.Duration {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return time.Duration(e.value)
+}
+
+//GetScore weighs the server's latency by its pending requests. A server without samples yet is
+//given the fallback latency, otherwise it would score 0 and win every comparison no matter
+//how many requests it's still stuck on.
+func (server *Server) GetScore(fallback time.Duration) float64 {
+	latency := server.Latency.Value()
+	if latency <= 0 {
+		latency = fallback
+	}
+	if latency <= 0 {
+		latency = defaultLatency
+	}
+	return float64(latency) * float64(server.GetActiveConnections()+1)
+}
@@ -0,0 +1,237 @@
+package serverutil
+
+import (
+	"balansir/internal/configutil"
+	"balansir/internal/proxyprotoutil"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//TCPCheckType ...
+	TCPCheckType = "tcp"
+	//HTTPCheckType ...
+	HTTPCheckType = "http"
+	//HTTPSCheckType ...
+	HTTPSCheckType = "https"
+
+	//Only the beginning of the body is inspected when body match is configured
+	maxCheckBodySize = 64 * 1024
+)
+
+//CheckResult ...
+type CheckResult struct {
+	Time       time.Time
+	Latency    time.Duration
+	StatusCode int
+	Success    bool
+	Error      string
+}
+
+type statusRange struct {
+	from int
+	to   int
+}
+
+//HealthChecker ...
+type HealthChecker struct {
+	checkType string
+	method    string
+	path      string
+	host      string
+	headers   http.Header
+	statuses  []statusRange
+	bodyMatch []byte
+	rise      int
+	fall      int
+	timeout   time.Duration
+	client    *http.Client
+	//PROXY protocol version the servers expect
+	proxyProtocol string
+}
+
+//NewHealthChecker ...
+func NewHealthChecker(healthCheck *configutil.HealthCheck, timeout int, proxyProtocol string) (*HealthChecker, error) {
+	checker := &HealthChecker{
+		checkType:     strings.ToLower(healthCheck.Type),
+		method:        strings.ToUpper(healthCheck.Method),
+		path:          healthCheck.Path,
+		headers:       http.Header{},
+		bodyMatch:     []byte(healthCheck.BodyMatch),
+		rise:          healthCheck.Rise,
+		fall:          healthCheck.Fall,
+		timeout:       time.Duration(timeout) * time.Second,
+		proxyProtocol: proxyProtocol,
+	}
+
+	switch checker.checkType {
+	case "":
+		checker.checkType = TCPCheckType
+	case TCPCheckType, HTTPCheckType, HTTPSCheckType:
+	default:
+		return nil, fmt.Errorf(`unknown health check type (%s) in config["health_check"]. Use one of the following: tcp, http, https`, healthCheck.Type)
+	}
+
+	if checker.method == "" {
+		checker.method = http.MethodGet
+	}
+	if checker.path == "" {
+		checker.path = "/"
+	}
+	if !strings.HasPrefix(checker.path, "/") {
+		checker.path = "/" + checker.path
+	}
+	if checker.rise <= 0 {
+		checker.rise = 1
+	}
+	if checker.fall <= 0 {
+		checker.fall = 1
+	}
+
+	for key, val := range healthCheck.Headers {
+		if strings.EqualFold(key, "Host") {
+			checker.host = val
+			continue
+		}
+		checker.headers.Set(key, val)
+	}
+
+	expectedStatus := healthCheck.ExpectedStatus
+	if len(expectedStatus) == 0 {
+		expectedStatus = []string{"200-399"}
+	}
+	for _, status := range expectedStatus {
+		statusRange, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+		checker.statuses = append(checker.statuses, statusRange)
+	}
+
+	checker.client = &http.Client{
+		Timeout: checker.timeout,
+		Transport: &http.Transport{
+			DialContext: proxyprotoutil.Dialer((&net.Dialer{
+				Timeout: checker.timeout,
+			}).DialContext),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: healthCheck.InsecureSkipVerify}, //nolint
+			DisableKeepAlives: true,
+		},
+		//Redirects are reported as is, so they can be matched against expected statuses
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return checker, nil
+}
+
+func parseStatusRange(status string) (statusRange, error) {
+	bounds := strings.SplitN(strings.TrimSpace(status), "-", 2)
+	from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return statusRange{}, fmt.Errorf(`malformed status (%s) in config["health_check"]["expected_status"]`, status)
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil || to < from {
+			return statusRange{}, fmt.Errorf(`malformed status range (%s) in config["health_check"]["expected_status"]`, status)
+		}
+	}
+	return statusRange{from: from, to: to}, nil
+}
+
+func (checker *HealthChecker) expectedStatus(code int) bool {
+	for _, status := range checker.statuses {
+		if code >= status.from && code <= status.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (checker *HealthChecker) probe(serverURL *url.URL) CheckResult {
+	start := time.Now()
+	var result CheckResult
+
+	switch checker.checkType {
+	case HTTPCheckType, HTTPSCheckType:
+		result = checker.probeHTTP(serverURL)
+	default:
+		result = checker.probeTCP(serverURL)
+	}
+
+	result.Time = start
+	result.Latency = time.Since(start)
+	return result
+}
+
+func (checker *HealthChecker) probeTCP(serverURL *url.URL) CheckResult {
+	connection, err := net.DialTimeout("tcp", serverURL.Host, checker.timeout)
+	if err != nil {
+		return CheckResult{Error: err.Error()}
+	}
+	defer connection.Close()
+
+	//Checks don't come from any client, so the header is sent with no addresses
+	if err := proxyprotoutil.WriteHeader(connection, checker.proxyProtocol, nil, nil); err != nil {
+		return CheckResult{Error: err.Error()}
+	}
+	return CheckResult{Success: true}
+}
+
+func (checker *HealthChecker) probeHTTP(serverURL *url.URL) CheckResult {
+	target := fmt.Sprintf("%s://%s%s", checker.checkType, serverURL.Host, checker.path)
+	req, err := http.NewRequest(checker.method, target, nil)
+	if err != nil {
+		return CheckResult{Error: err.Error()}
+	}
+	for key, val := range checker.headers {
+		req.Header[key] = val
+	}
+	if checker.host != "" {
+		req.Host = checker.host
+	}
+	req.Header.Set("User-Agent", "Balansir-Health-Check")
+	if checker.proxyProtocol != "" {
+		req = req.WithContext(proxyprotoutil.WithHeader(context.Background(), checker.proxyProtocol, nil, nil))
+	}
+
+	res, err := checker.client.Do(req)
+	if err != nil {
+		return CheckResult{Error: err.Error()}
+	}
+	defer res.Body.Close()
+
+	result := CheckResult{StatusCode: res.StatusCode}
+	if !checker.expectedStatus(res.StatusCode) {
+		result.Error = fmt.Sprintf("unexpected status code %v", res.StatusCode)
+		return result
+	}
+
+	if len(checker.bodyMatch) > 0 {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCheckBodySize))
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		if !bytes.Contains(body, checker.bodyMatch) {
+			result.Error = "response body doesn't match"
+			return result
+		}
+	}
+
+	result.Success = true
+	return result
+}
@@ -0,0 +1,108 @@
+package serverutil
+
+import (
+	"time"
+)
+
+//HitStatus ...
+func (server *Server) HitStatus(statusCode int) int {
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+
+	server.consecutiveErrors = 0
+	if statusCode >= 500 {
+		server.consecutive5xx++
+	} else {
+		server.consecutive5xx = 0
+	}
+	return server.consecutive5xx
+}
+
+//HitConnect ...
+func (server *Server) HitConnect() {
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+	server.consecutiveErrors = 0
+}
+
+//HitError ...
+func (server *Server) HitError() int {
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+
+	server.consecutiveErrors++
+	return server.consecutiveErrors
+}
+
+//Eject ...
+func (server *Server) Eject(baseTime time.Duration, maxTime time.Duration) time.Duration {
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+
+	//Server that behaved well for longer than max ejection time starts over
+	if !server.readmittedAt.IsZero() && time.Since(server.readmittedAt) > maxTime {
+		server.ejectionMultiplier = 0
+	}
+
+	server.ejectionMultiplier++
+	duration := baseTime * time.Duration(server.ejectionMultiplier)
+	if duration > maxTime {
+		duration = maxTime
+	}
+
+	server.Ejections++
+	server.ejected = true
+	server.ejectedUntil = time.Now().Add(duration)
+	server.consecutive5xx = 0
+	server.consecutiveErrors = 0
+
+	return duration
+}
+
+//Readmit ...
+func (server *Server) Readmit() bool {
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+
+	if !server.ejected || time.Now().Before(server.ejectedUntil) {
+		return false
+	}
+
+	server.ejected = false
+	server.readmittedAt = time.Now()
+	return true
+}
+
+//GetEjected ...
+func (server *Server) GetEjected() bool {
+	server.Mux.RLock()
+	defer server.Mux.RUnlock()
+	return server.ejected && time.Now().Before(server.ejectedUntil)
+}
+
+//GetEjections ...
+func (server *Server) GetEjections() int64 {
+	server.Mux.RLock()
+	defer server.Mux.RUnlock()
+	return server.Ejections
+}
+
+//InheritEjection takes the ejection state over from the server it replaces,
+//so a reload doesn't readmit an ejected server early or reset its backoff
+func (server *Server) InheritEjection(old *Server) {
+	old.Mux.RLock()
+	ejections, ejected, ejectedUntil := old.Ejections, old.ejected, old.ejectedUntil
+	multiplier, readmittedAt := old.ejectionMultiplier, old.readmittedAt
+	consecutive5xx, consecutiveErrors := old.consecutive5xx, old.consecutiveErrors
+	old.Mux.RUnlock()
+
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+	server.Ejections = ejections
+	server.ejected = ejected
+	server.ejectedUntil = ejectedUntil
+	server.ejectionMultiplier = multiplier
+	server.readmittedAt = readmittedAt
+	server.consecutive5xx = consecutive5xx
+	server.consecutiveErrors = consecutiveErrors
+}
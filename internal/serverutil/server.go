@@ -3,7 +3,6 @@ package serverutil
 import (
 	"balansir/internal/logutil"
 	"fmt"
-	"net"
 	"net/http/httputil"
 	"net/url"
 	"sync"
@@ -13,14 +12,32 @@ import (
 
 //Server ...
 type Server struct {
-	URL               *url.URL
-	Weight            float64
-	Index             int
-	ActiveConnections int64
-	Alive             bool
-	Proxy             *httputil.ReverseProxy
-	ServerHash        string
-	Mux               sync.RWMutex
+	URL                *url.URL
+	Weight             float64
+	Priority           int
+	MaxConnections     int
+	MaxRequests        int
+	CurrentWeight      float64
+	Index              int
+	ActiveConnections  int64
+	inFlight           int64
+	Alive              bool
+	Proxy              *httputil.ReverseProxy
+	ServerHash         string
+	LastCheck          CheckResult
+	Ejections          int64
+	Breaker            *CircuitBreaker
+	Latency            EWMA
+	Mux                sync.RWMutex
+	successes          int
+	failures           int
+	consecutive5xx     int
+	consecutiveErrors  int
+	ejected            bool
+	ejectedUntil       time.Time
+	ejectionMultiplier int
+	readmittedAt       time.Time
+	aliveSince         time.Time
 }
 
 //GetAlive ...
@@ -38,22 +55,76 @@ func (server *Server) SetAlive(status bool) {
 	server.Alive = status
 }
 
+//Available ...
+func (server *Server) Available() bool {
+	server.Mux.RLock()
+	available := server.Alive && !(server.ejected && time.Now().Before(server.ejectedUntil))
+	server.Mux.RUnlock()
+	return available && server.Breaker.Ready()
+}
+
 //CheckAlive ...
-func (server *Server) CheckAlive(tcpTimeout *int) bool {
-	configurationTimeout := *tcpTimeout
-	timeout := time.Second * time.Duration(configurationTimeout)
-	connection, err := net.DialTimeout("tcp", server.URL.Host, timeout)
-	if err != nil {
-		server.SetAlive(false)
-		logutil.Warning(fmt.Sprintf("Server is down: %v", err))
-		return false
-	}
-	connection.Close()
-	if !server.GetAlive() {
-		logutil.Notice(fmt.Sprintf("Server is up: %v", server.URL.Host))
+func (server *Server) CheckAlive(checker *HealthChecker) bool {
+	result := checker.probe(server.URL)
+
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+
+	server.LastCheck = result
+	if result.Success {
+		server.failures = 0
+		server.successes++
+		if !server.Alive && server.successes >= checker.rise {
+			server.Alive = true
+			server.aliveSince = time.Now()
+			logutil.Notice(fmt.Sprintf("Server is up: %v", server.URL.Host))
+		}
+	} else {
+		server.successes = 0
+		server.failures++
+		if server.Alive && server.failures >= checker.fall {
+			server.Alive = false
+			logutil.Warning(fmt.Sprintf("Server is down: %v: %v", server.URL.Host, result.Error))
+		}
 	}
-	server.SetAlive(true)
-	return true
+
+	return server.Alive
+}
+
+//InheritHealth takes the health check state over from the server it replaces, so a reload
+//neither brings a dead server back nor resets its progress towards rise and fall
+func (server *Server) InheritHealth(old *Server) {
+	old.Mux.RLock()
+	alive, lastCheck, successes, failures := old.Alive, old.LastCheck, old.successes, old.failures
+	old.Mux.RUnlock()
+
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+	server.Alive = alive
+	server.LastCheck = lastCheck
+	server.successes = successes
+	server.failures = failures
+}
+
+//GetAliveSince returns the time the server came alive, zero time means it's been alive from the start
+func (server *Server) GetAliveSince() time.Time {
+	server.Mux.RLock()
+	defer server.Mux.RUnlock()
+	return server.aliveSince
+}
+
+//SetAliveSince ...
+func (server *Server) SetAliveSince(since time.Time) {
+	server.Mux.Lock()
+	defer server.Mux.Unlock()
+	server.aliveSince = since
+}
+
+//GetLastCheck ...
+func (server *Server) GetLastCheck() CheckResult {
+	server.Mux.RLock()
+	defer server.Mux.RUnlock()
+	return server.LastCheck
 }
 
 //IncreaseActiveConnections ...
@@ -66,6 +137,46 @@ func (server *Server) DecreaseActiveConnections() {
 	atomic.AddInt64(&server.ActiveConnections, -1)
 }
 
+//TryAcquire takes a request slot, unless the server is at its max requests or connections limit
+func (server *Server) TryAcquire() bool {
+	limit := server.limit()
+	for {
+		inFlight := atomic.LoadInt64(&server.inFlight)
+		if limit > 0 && inFlight >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&server.inFlight, inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+//Release ...
+func (server *Server) Release() {
+	atomic.AddInt64(&server.inFlight, -1)
+}
+
+//HasCapacity ...
+func (server *Server) HasCapacity() bool {
+	limit := server.limit()
+	return limit <= 0 || atomic.LoadInt64(&server.inFlight) < limit
+}
+
+//Every request in flight holds a connection to the backend until it's done, tunnels and
+//layer 4 connections included, so max connections caps the requests the same way max requests does
+func (server *Server) limit() int64 {
+	limit := server.MaxRequests
+	if server.MaxConnections > 0 && (limit <= 0 || server.MaxConnections < limit) {
+		limit = server.MaxConnections
+	}
+	return int64(limit)
+}
+
+//GetInFlight ...
+func (server *Server) GetInFlight() int64 {
+	return atomic.LoadInt64(&server.inFlight)
+}
+
 //GetActiveConnections ...
 func (server *Server) GetActiveConnections() int64 {
 	return atomic.LoadInt64(&server.ActiveConnections)
@@ -0,0 +1,42 @@
+package serverutil
+
+import "testing"
+
+func TestTryAcquire(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxRequests    int
+		maxConnections int
+		want           int
+	}{
+		{name: "no limits", want: 10},
+		{name: "max requests", maxRequests: 3, want: 3},
+		{name: "max connections", maxConnections: 2, want: 2},
+		{name: "lower of both", maxRequests: 5, maxConnections: 4, want: 4},
+		{name: "lower of both reversed", maxRequests: 4, maxConnections: 5, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{MaxRequests: tt.maxRequests, MaxConnections: tt.maxConnections}
+
+			acquired := 0
+			for i := 0; i < 10; i++ {
+				if server.TryAcquire() {
+					acquired++
+				}
+			}
+			if acquired != tt.want {
+				t.Fatalf("acquired %v slots, want %v", acquired, tt.want)
+			}
+			if tt.want < 10 && server.HasCapacity() {
+				t.Fatal("server at its limit reports capacity")
+			}
+
+			server.Release()
+			if !server.HasCapacity() || !server.TryAcquire() {
+				t.Fatal("released slot can't be taken again")
+			}
+		})
+	}
+}
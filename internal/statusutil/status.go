@@ -16,20 +16,29 @@ var once sync.Once
 //GetStatusCodes ...
 func GetStatusCodes() *StatusCodes {
 	once.Do(func() {
-		statusCodes = &StatusCodes{
-			Storage: make(map[int]int64),
-		}
+		statusCodes = NewStatusCodes()
 	})
 
 	return statusCodes
 }
 
+//NewStatusCodes ...
+func NewStatusCodes() *StatusCodes {
+	return &StatusCodes{
+		Storage: make(map[int]int64),
+	}
+}
+
 //GetStatuses ...
 func (sm *StatusCodes) GetStatuses() map[int]int64 {
 	sm.mux.RLock()
 	defer sm.mux.RUnlock()
 
-	return sm.Storage
+	statuses := make(map[int]int64, len(sm.Storage))
+	for code, count := range sm.Storage {
+		statuses[code] = count
+	}
+	return statuses
 }
 
 //HitStatus ...
@@ -0,0 +1,158 @@
+package tunnelutil
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+//Counters of the connections or flows passed through a listener or to a backend.
+//They're kept between config reloads.
+type Counters struct {
+	active     int64
+	total      int64
+	bytesIn    int64
+	bytesOut   int64
+	packetsIn  int64
+	packetsOut int64
+	dropped    int64
+}
+
+var counters = make(map[string]*Counters)
+var countersMux sync.Mutex
+
+//GetCounters returns the listener's counters, creating them on the first call
+func GetCounters(name string) *Counters {
+	countersMux.Lock()
+	defer countersMux.Unlock()
+
+	c, ok := counters[name]
+	if !ok {
+		c = &Counters{}
+		counters[name] = c
+	}
+	return c
+}
+
+//GetBackendCounters returns the counters of the listener's backend
+func GetBackendCounters(listener string, backend string) *Counters {
+	return GetCounters(listener + "/" + backend)
+}
+
+//Open counts a new connection or flow
+func (c *Counters) Open() {
+	atomic.AddInt64(&c.active, 1)
+	atomic.AddInt64(&c.total, 1)
+}
+
+//Close ...
+func (c *Counters) Close() {
+	atomic.AddInt64(&c.active, -1)
+}
+
+//CountIn counts a packet sent by the client
+func (c *Counters) CountIn(bytes int) {
+	atomic.AddInt64(&c.packetsIn, 1)
+	atomic.AddInt64(&c.bytesIn, int64(bytes))
+}
+
+//CountOut counts a packet sent back to the client
+func (c *Counters) CountOut(bytes int) {
+	atomic.AddInt64(&c.packetsOut, 1)
+	atomic.AddInt64(&c.bytesOut, int64(bytes))
+}
+
+//CountDropped counts a packet that couldn't be forwarded
+func (c *Counters) CountDropped() {
+	atomic.AddInt64(&c.dropped, 1)
+}
+
+//GetActive ...
+func (c *Counters) GetActive() int64 {
+	return atomic.LoadInt64(&c.active)
+}
+
+//GetTotal ...
+func (c *Counters) GetTotal() int64 {
+	return atomic.LoadInt64(&c.total)
+}
+
+//GetBytesIn ...
+func (c *Counters) GetBytesIn() int64 {
+	return atomic.LoadInt64(&c.bytesIn)
+}
+
+//GetBytesOut ...
+func (c *Counters) GetBytesOut() int64 {
+	return atomic.LoadInt64(&c.bytesOut)
+}
+
+//GetPacketsIn ...
+func (c *Counters) GetPacketsIn() int64 {
+	return atomic.LoadInt64(&c.packetsIn)
+}
+
+//GetPacketsOut ...
+func (c *Counters) GetPacketsOut() int64 {
+	return atomic.LoadInt64(&c.packetsOut)
+}
+
+//GetDropped ...
+func (c *Counters) GetDropped() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+//Pipe copies data between the client and the backend until both sides are done or the connection
+//is closed by the idle timeout or max lifetime. Both connections are closed afterwards.
+func Pipe(client, backend net.Conn, settings Settings, c *Counters) {
+	c.Open()
+	defer c.Close()
+
+	tc := newConn(client, settings)
+	defer tc.Close()
+	defer backend.Close()
+
+	//Timed out client connection takes the backend one down with it
+	go func() {
+		<-tc.done
+		backend.Close()
+	}()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(&countingWriter{w: backend, n: &c.bytesIn}, tc) //nolint
+		closeWrite(backend)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(&countingWriter{w: tc, n: &c.bytesOut}, backend) //nolint
+		closeWrite(tc)
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
+
+//Half-closed connection lets the other side finish sending its data
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+	conn.Close()
+}
+
+//Bytes are counted as they go, so long-lived connections show up in metrics too
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
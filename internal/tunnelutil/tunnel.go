@@ -0,0 +1,214 @@
+package tunnelutil
+
+import (
+	"balansir/internal/configutil"
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultIdleTimeout = 300
+
+var streamingTypes = []string{"text/event-stream", "application/x-ndjson", "application/stream+json", "application/grpc", "multipart/x-mixed-replace"}
+
+var open int64
+
+//Settings ...
+type Settings struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+//GetSettings ...
+func GetSettings(tunnel *configutil.Tunnel) Settings {
+	settings := Settings{
+		IdleTimeout: time.Duration(tunnel.IdleTimeout) * time.Second,
+		MaxLifetime: time.Duration(tunnel.MaxLifetime) * time.Second,
+	}
+	if settings.IdleTimeout <= 0 {
+		settings.IdleTimeout = defaultIdleTimeout * time.Second
+	}
+	return settings
+}
+
+//IsUpgrade reports whether the request asks to switch protocols
+func IsUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, val := range r.Header["Connection"] {
+		for _, token := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//IsStreaming reports whether the response is an endless stream, that must be neither buffered nor cached
+func IsStreaming(r *http.Response) bool {
+	if r.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	for _, sType := range streamingTypes {
+		if contentType == sType || strings.HasPrefix(contentType, sType+"+") {
+			return true
+		}
+	}
+	return false
+}
+
+//GetOpen returns the number of open tunnels
+func GetOpen() int64 {
+	return atomic.LoadInt64(&open)
+}
+
+//Wrap applies tunnel timeouts to the connections hijacked through the response writer.
+//Streaming responses are exempt from the server's write timeout, only the max lifetime applies.
+//They are flushed on every write, the same way a proxy with negative flush interval does.
+func Wrap(w http.ResponseWriter, settings Settings) http.ResponseWriter {
+	return &writer{ResponseWriter: w, settings: settings}
+}
+
+type writer struct {
+	http.ResponseWriter
+	settings    Settings
+	wroteHeader bool
+	streaming   bool
+}
+
+func (tw *writer) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		if IsStreaming(&http.Response{StatusCode: status, Header: tw.Header()}) {
+			tw.streaming = true
+			var deadline time.Time
+			if tw.settings.MaxLifetime > 0 {
+				deadline = time.Now().Add(tw.settings.MaxLifetime)
+			}
+			http.NewResponseController(tw.ResponseWriter).SetWriteDeadline(deadline) //nolint
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *writer) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	n, err := tw.ResponseWriter.Write(b)
+	if err == nil && tw.streaming {
+		//Writers that can't flush, like the mirror's one, have nobody to flush to
+		http.NewResponseController(tw.ResponseWriter).Flush() //nolint
+	}
+	return n, err
+}
+
+func (tw *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(tw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newConn(conn, tw.settings), brw, nil
+}
+
+//Unwrap lets http.ResponseController reach the underlying writer
+func (tw *writer) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+//ErrCloseWrite ...
+var ErrCloseWrite = errors.New("connection doesn't support half-close")
+
+//conn closes itself once there is no traffic in either direction for the idle timeout
+//or the max lifetime is reached
+type conn struct {
+	net.Conn
+	settings   Settings
+	lastActive int64
+	done       chan struct{}
+	once       sync.Once
+}
+
+func newConn(c net.Conn, settings Settings) *conn {
+	tc := &conn{
+		Conn:       c,
+		settings:   settings,
+		lastActive: time.Now().UnixNano(),
+		done:       make(chan struct{}),
+	}
+	atomic.AddInt64(&open, 1)
+	go tc.watch()
+	return tc
+}
+
+func (c *conn) watch() {
+	interval := c.settings.IdleTimeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lifetime <-chan time.Time
+	if c.settings.MaxLifetime > 0 {
+		timer := time.NewTimer(c.settings.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-lifetime:
+			c.Close()
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive))) >= c.settings.IdleTimeout {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+//CloseWrite passes the backend's EOF on to the client
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrCloseWrite
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		atomic.AddInt64(&open, -1)
+	})
+	return c.Conn.Close()
+}
@@ -3,23 +3,30 @@ package watchutil
 import (
 	"balansir/internal/cacheutil"
 	"balansir/internal/configutil"
+	"balansir/internal/forwardutil"
 	"balansir/internal/helpers"
+	"balansir/internal/limitutil"
+	"balansir/internal/listenutil"
 	"balansir/internal/logutil"
 	"balansir/internal/metricsutil"
 	"balansir/internal/poolutil"
+	"balansir/internal/proxyprotoutil"
 	"balansir/internal/rateutil"
+	"balansir/internal/routeutil"
+	"balansir/internal/serverutil"
 	"balansir/internal/statusutil"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
-var serverPoolHash string
+var serverPoolHashes = make(map[string]string)
 var cacheHash string
 
 //FillConfiguration ...
@@ -36,20 +43,79 @@ func FillConfiguration(file []byte) []error {
 	defer pool.Guard.Done()
 
 	var errs []error
-	if err := yaml.Unmarshal(file, &configuration); err != nil {
+	//Unmarshaling in place would keep the settings removed from the file
+	parsed := &configutil.Configuration{}
+	if err := yaml.Unmarshal(file, parsed); err != nil {
 		errs = append(errs, errors.New(fmt.Sprint("config.yml malformed: ", err)))
 		return errs
 	}
+	parsed.Name = poolutil.DefaultPoolName
+	configuration.Update(parsed)
 
-	if !helpers.ServerPoolsEquals(&serverPoolHash, configuration.ServerList) {
-		newPool, err := poolutil.RedefineServerPool(configuration, &pool.Guard)
-		if err != nil {
-			errs = append(errs, err)
+	//Pool gets its own copy, so it doesn't change under the requests on the next reload
+	upstream := configuration.Upstream
+	newPool, poolErrs := fillPool(&upstream, pool)
+	errs = append(errs, poolErrs...)
+	poolutil.SetPool(newPool)
+
+	upstreams := map[string]bool{poolutil.DefaultPoolName: true}
+	pools := make(map[string]*poolutil.ServerPool)
+	for _, upstream := range configuration.Upstreams {
+		if upstream.Name == "" || upstreams[upstream.Name] {
+			errs = append(errs, fmt.Errorf(`upstream name (%s) in config["upstreams"] must be unique, non-empty and differ from "%s"`, upstream.Name, poolutil.DefaultPoolName))
+			continue
 		}
-		if newPool != nil {
-			poolutil.SetPool(newPool)
+		upstreams[upstream.Name] = true
+		inheritUpstream(upstream, &configuration.Upstream)
+
+		oldPool := poolutil.GetPoolByName(upstream.Name)
+		if oldPool == nil {
+			oldPool = &poolutil.ServerPool{Name: upstream.Name}
+			delete(serverPoolHashes, upstream.Name)
+		}
+
+		newPool, poolErrs := fillPool(upstream, oldPool)
+		errs = append(errs, poolErrs...)
+		pools[upstream.Name] = newPool
+	}
+	poolutil.SetPools(pools)
+
+	for name := range serverPoolHashes {
+		if !upstreams[name] {
+			delete(serverPoolHashes, name)
+		}
+	}
+
+	table, err := routeutil.NewTable(configuration.Routes, upstreams)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		routeutil.SetTable(table)
+	}
+
+	errs = append(errs, fillListeners(configuration, upstreams)...)
+
+	var trusted []*net.IPNet
+	if configuration.AcceptProxy.Enabled {
+		trusted, err = helpers.ParseCIDRs(configuration.AcceptProxy.TrustedCIDRs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`malformed CIDR in config["accept_proxy_protocol"]["trusted_cidrs"]: %w`, err))
+		} else if len(trusted) == 0 {
+			errs = append(errs, errors.New(`config["accept_proxy_protocol"]["trusted_cidrs"] must list the sources allowed to send PROXY protocol header`))
 		}
 	}
+	proxyprotoutil.SetTrusted(trusted)
+
+	proxies, err := helpers.ParseCIDRs(configuration.TrustedProxies)
+	if err != nil {
+		errs = append(errs, fmt.Errorf(`malformed CIDR in config["trusted_proxies"]: %w`, err))
+	} else {
+		forwardutil.SetTrustedProxies(proxies)
+	}
+
+	if configuration.Cache.Enabled && !cacheutil.ValidMode(configuration.Cache.Mode) {
+		errs = append(errs, fmt.Errorf(`unknown cache mode (%s) in config["cache"]["mode"]. Use one of the following: rules, rfc`, configuration.Cache.Mode))
+	}
 
 	if configuration.Cache.Enabled {
 		args := cacheutil.CacheClusterArgs{
@@ -73,10 +139,119 @@ func FillConfiguration(file []byte) []error {
 
 	rateCounter := rateutil.GetRateCounter()
 	statusCodes := statusutil.GetStatusCodes()
-	metricsutil.InitMetricsMeta(rateCounter, configuration, pool.ServerList, statusCodes)
+	metricsutil.InitMetricsMeta(rateCounter, configuration, poolutil.GetPool().ServerList, statusCodes)
 	return errs
 }
 
+//fillPool redefines the pool if its server list has changed. The old pool keeps serving
+//on errors, but always gets the fresh upstream settings.
+func fillPool(upstream *configutil.Upstream, oldPool *poolutil.ServerPool) (*poolutil.ServerPool, []error) {
+	var errs []error
+
+	if !proxyprotoutil.Valid(upstream.SendProxyProtocol) {
+		errs = append(errs, fmt.Errorf(`unknown PROXY protocol version (%s) for (%s) upstream in config["send_proxy_protocol"]. Use one of the following: v1, v2`, upstream.SendProxyProtocol, upstream.Name))
+		upstream.SendProxyProtocol = ""
+	}
+
+	checker, err := serverutil.NewHealthChecker(&upstream.HealthCheck, upstream.Timeout, upstream.SendProxyProtocol)
+	if err != nil {
+		errs = append(errs, err)
+		checker = oldPool.GetHealthChecker()
+	}
+
+	pool := oldPool
+	serverPoolHash := serverPoolHashes[upstream.Name]
+	if !helpers.ServerPoolsEquals(&serverPoolHash, upstream.ServerList) {
+		newPool, err := poolutil.RedefineServerPool(upstream, oldPool)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if newPool != nil {
+			pool = newPool
+		}
+	}
+	serverPoolHashes[upstream.Name] = serverPoolHash
+
+	pool.SetUpstream(upstream, checker)
+	if pool.StatusCodes == nil {
+		pool.StatusCodes = statusutil.NewStatusCodes()
+	}
+	if pool.Limiter == nil {
+		pool.Limiter = &limitutil.AdaptiveLimiter{}
+	}
+
+	return pool, errs
+}
+
+//fillListeners validates layer 4 listeners and binds the new ones
+func fillListeners(configuration *configutil.Configuration, upstreams map[string]bool) []error {
+	var errs []error
+	var listeners []*configutil.Listener
+	names := make(map[string]bool)
+	for _, listener := range configuration.Listeners {
+		if listener.Name == "" || names[listener.Name] {
+			errs = append(errs, fmt.Errorf(`listener name (%s) in config["listeners"] must be unique and non-empty`, listener.Name))
+			continue
+		}
+		names[listener.Name] = true
+
+		if listener.Protocol == "" {
+			listener.Protocol = listenutil.TCPProtocol
+		}
+		if listener.Protocol != listenutil.TCPProtocol && listener.Protocol != listenutil.UDPProtocol {
+			errs = append(errs, fmt.Errorf(`unknown protocol (%s) for (%s) listener in config["listeners"]. Use one of the following: tcp, udp`, listener.Protocol, listener.Name))
+			continue
+		}
+		if listener.Protocol == listenutil.UDPProtocol {
+			switch listener.Mode {
+			case "":
+				listener.Mode = listenutil.UDPFlowMode
+			case listenutil.UDPFlowMode, listenutil.UDPHashMode:
+			default:
+				errs = append(errs, fmt.Errorf(`unknown mode (%s) for (%s) listener in config["listeners"]. Use one of the following: flow, hash`, listener.Mode, listener.Name))
+				continue
+			}
+		}
+		if listener.Port <= 0 || listener.Port == configuration.Port || listener.Port == configuration.TLSPort {
+			errs = append(errs, fmt.Errorf(`port (%v) of (%s) listener in config["listeners"] must be positive and differ from http_port and tls_port`, listener.Port, listener.Name))
+			continue
+		}
+		if !upstreams[listener.Upstream] {
+			errs = append(errs, fmt.Errorf(`unknown upstream (%s) is specified for (%s) listener in config["listeners"]`, listener.Upstream, listener.Name))
+			continue
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return append(errs, listenutil.SyncListeners(listeners)...)
+}
+
+//Named upstreams fall back to the top-level settings for omitted timeouts and algorithm
+func inheritUpstream(upstream *configutil.Upstream, defaults *configutil.Upstream) {
+	if upstream.Algorithm == "" {
+		upstream.Algorithm = defaults.Algorithm
+	}
+	if upstream.Delay == 0 {
+		upstream.Delay = defaults.Delay
+	}
+	if upstream.Timeout == 0 {
+		upstream.Timeout = defaults.Timeout
+	}
+	if upstream.ReadTimeout == 0 {
+		upstream.ReadTimeout = defaults.ReadTimeout
+	}
+	if upstream.WriteTimeout == 0 {
+		upstream.WriteTimeout = defaults.WriteTimeout
+	}
+	if upstream.Tunnel.IdleTimeout == 0 {
+		upstream.Tunnel.IdleTimeout = defaults.Tunnel.IdleTimeout
+	}
+	if upstream.Tunnel.MaxLifetime == 0 {
+		upstream.Tunnel.MaxLifetime = defaults.Tunnel.MaxLifetime
+	}
+}
+
 //WatchConfig ...
 func WatchConfig() {
 	file, err := ioutil.ReadFile("config.yml")